@@ -0,0 +1,60 @@
+package main
+
+import (
+	"dead-drop/lib"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
+	"os"
+)
+
+// Keys in ssh-agent (or whatever hardware it fronts) never leave it, so the agent signs requests on our behalf.
+// The key is chosen by its comment, which is its name on the server (as in an authorized_keys file).
+type agentSigner struct {
+	agent agent.ExtendedAgent
+	key   ssh.PublicKey
+}
+
+func dialAgentSigner(keyName string) (*agentSigner, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, fmt.Errorf("SSH_AUTH_SOCK is not set, is ssh-agent running?")
+	}
+
+	// The connection is kept open for the life of the process, since the signer is cached.
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to ssh-agent: %v", err)
+	}
+
+	return newAgentSigner(agent.NewClient(conn), keyName)
+}
+
+func newAgentSigner(sshAgent agent.ExtendedAgent, keyName string) (*agentSigner, error) {
+	keys, err := sshAgent.List()
+	if err != nil {
+		return nil, fmt.Errorf("error listing ssh-agent keys: %v", err)
+	}
+
+	for _, key := range keys {
+		if key.Comment == keyName {
+			return &agentSigner{agent: sshAgent, key: key}, nil
+		}
+	}
+	return nil, fmt.Errorf("ssh-agent has no key with the comment '%s'", keyName)
+}
+
+func (signer *agentSigner) Sign(message []byte) ([]byte, string, error) {
+	// RSA keys would otherwise sign with SHA-1, which the server does not accept.
+	var flags agent.SignatureFlags
+	if signer.key.Type() == ssh.KeyAlgoRSA {
+		flags = agent.SignatureFlagRsaSha256
+	}
+
+	sig, err := signer.agent.SignWithFlags(signer.key, message, flags)
+	if err != nil {
+		return nil, "", fmt.Errorf("ssh-agent failed to sign: %v", err)
+	}
+	return ssh.Marshal(sig), lib.SSHSignatureFormat, nil
+}
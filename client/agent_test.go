@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"dead-drop/lib"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Serves an in-process agent on a unix socket, as ssh-agent would, and points SSH_AUTH_SOCK at it.
+func startTestAgent(t *testing.T, keyring agent.Agent) func() {
+	dir, err := ioutil.TempDir("", "dead-drop-agent")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	socket := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen on agent socket: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+
+	oldSocket := os.Getenv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", socket)
+	return func() {
+		os.Setenv("SSH_AUTH_SOCK", oldSocket)
+		listener.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAgentSigner(t *testing.T) {
+	keyring := agent.NewKeyring()
+	defer startTestAgent(t, keyring)()
+
+	keys := make(map[string]crypto.Signer)
+	for _, keyType := range []string{rsaKeyType, ed25519KeyType, ecdsaKeyType} {
+		privKey, err := generateKey(keyType)
+		if err != nil {
+			t.Fatalf("Failed to generate %s key: %v", keyType, err)
+		}
+		if err := keyring.Add(agent.AddedKey{PrivateKey: privKey, Comment: keyType + "@laptop"}); err != nil {
+			t.Fatalf("Failed to add %s key to agent: %v", keyType, err)
+		}
+		keys[keyType] = privKey
+	}
+
+	message := []byte("message")
+	for keyType, privKey := range keys {
+		signer, err := dialAgentSigner(keyType + "@laptop")
+		if err != nil {
+			t.Fatalf("Failed to find %s key in agent: %v", keyType, err)
+		}
+
+		signature, format, err := signer.Sign(message)
+		if err != nil {
+			t.Fatalf("Failed to sign with %s key: %v", keyType, err)
+		}
+		if format != lib.SSHSignatureFormat || !lib.VerifySSHSignature(privKey.Public(), message, signature) {
+			t.Fatalf("Signature of %s key does not verify", keyType)
+		}
+		if lib.VerifySSHSignature(privKey.Public(), []byte("other message"), signature) {
+			t.Fatalf("Signature of %s key verifies another message", keyType)
+		}
+	}
+
+	if _, err := dialAgentSigner("nobody"); err == nil {
+		t.Fatalf("Expected a key name without a key in the agent to be rejected")
+	}
+
+	// Plain ssh-rsa signatures use SHA-1, so are rejected.
+	sshSigner, err := ssh.NewSignerFromKey(keys[rsaKeyType])
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	sha1Sig, err := sshSigner.Sign(rand.Reader, message)
+	if err != nil || sha1Sig.Format != ssh.KeyAlgoRSA {
+		t.Fatalf("Failed to sign with ssh-rsa: %v", err)
+	}
+	if lib.VerifySSHSignature(keys[rsaKeyType].Public(), message, ssh.Marshal(sha1Sig)) {
+		t.Fatalf("Expected an ssh-rsa signature to be rejected")
+	}
+}
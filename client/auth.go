@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"dead-drop/lib"
+	"encoding/hex"
+	"fmt"
+	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// Requests are signed either with the private key file, or by ssh-agent.
+type Signer interface {
+	// Returns the signature of the message, and its format (see lib.RequestSignature).
+	Sign(message []byte) ([]byte, string, error)
+}
+
+type keySigner struct {
+	privKey crypto.Signer
+}
+
+func (signer *keySigner) Sign(message []byte) ([]byte, string, error) {
+	signature, err := lib.Sign(signer.privKey, message)
+	return signature, "", err
+}
+
+// The signer is loaded once, and kept for the requests that follow (e.g. the chunks of an upload).
+var signerCache struct {
+	lock   sync.Mutex
+	signer Signer
+}
+
+func loadSigner(keyName string) (Signer, error) {
+	signerCache.lock.Lock()
+	defer signerCache.lock.Unlock()
+
+	if signerCache.signer != nil {
+		return signerCache.signer, nil
+	}
+
+	var signer Signer
+	if viper.GetBool(sshAgentFlag) {
+		agentSigner, err := dialAgentSigner(keyName)
+		if err != nil {
+			return nil, err
+		}
+		signer = agentSigner
+	} else {
+		rawPrivKeyPath, err := getStringFlag(privKeyFlag)
+		if err != nil {
+			return nil, err
+		}
+
+		privKey, err := loadPrivateKey(rawPrivKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		signer = &keySigner{privKey: privKey}
+	}
+
+	signerCache.signer = signer
+	return signer, nil
+}
+
+// Requests are signed with a nonce from the server, which can only be used once. Every response to an authenticated
+// request carries the nonce for the next one, so only the first request needs to fetch a nonce from /challenge.
+type nonceCache struct {
+	lock   sync.Mutex
+	nonces map[string]string
+}
+
+var nonces = &nonceCache{nonces: make(map[string]string)}
+
+func (cache *nonceCache) take(client *http.Client, remote string) (string, error) {
+	cache.lock.Lock()
+	nonce, ok := cache.nonces[remote]
+	delete(cache.nonces, remote)
+	cache.lock.Unlock()
+
+	if ok {
+		return nonce, nil
+	}
+	return requestChallenge(client, remote)
+}
+
+func (cache *nonceCache) put(remote string, nonce string) {
+	if nonce == "" {
+		return
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.nonces[remote] = nonce
+}
+
+func requestChallenge(client *http.Client, remote string) (string, error) {
+	resp, err := client.Get(fmt.Sprintf("%s/challenge", remote))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("challenge response status: %s", resp.Status)
+	}
+
+	challenge, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(challenge), nil
+}
+
+// The signature covers the hash of the body, so the body must be replayable (e.g. a bytes.Buffer) to be hashed
+// before it is sent.
+func requestContentHash(req *http.Request) (string, error) {
+	digest := sha256.New()
+
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return "", fmt.Errorf("streamed request bodies cannot be signed")
+		}
+
+		body, err := req.GetBody()
+		if err != nil {
+			return "", err
+		}
+		defer body.Close()
+
+		if _, err := io.Copy(digest, body); err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+func signRequest(req *http.Request, signer Signer, keyName string, nonce string, contentHash string) error {
+	message := lib.RequestSignatureMessage(keyName, nonce, req.Method, req.URL.RequestURI(), contentHash)
+
+	signature, format, err := signer.Sign(message)
+	if err != nil {
+		return fmt.Errorf("failed to sign request: %v", err)
+	}
+
+	sig := &lib.RequestSignature{KeyName: keyName, Nonce: nonce, Signature: signature, Format: format}
+	req.Header.Set("Authorization", sig.String())
+	req.Header.Set(lib.ContentHashHeader, contentHash)
+	return nil
+}
@@ -2,12 +2,8 @@ package main
 
 import (
 	"bytes"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha256"
-	"crypto/sha512"
 	"crypto/tls"
-	"crypto/x509"
 	"dead-drop/lib"
 	"encoding/base64"
 	"encoding/json"
@@ -17,11 +13,17 @@ import (
 	"github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"hash"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const remoteFlag = "remote"
@@ -29,21 +31,39 @@ const privKeyFlag = "private-key"
 const encryptionKeyFlag = "encryption-key"
 const keyNameFlag = "key-name"
 const insecureSkipVerifyFlag = "insecure-skip-verify"
+const ttlFlag = "ttl"
+const maxPullsFlag = "max-pulls"
+const recipientFlag = "recipient"
+const sharedKeyFlag = "shared-key"
+const capabilityFlag = "capability"
+const passphraseFlag = "passphrase"
+const cipherFlag = "cipher"
+const noteFlag = "note"
+const compressFlag = "compress"
+const keyTypeFlag = "type"
+const sshAgentFlag = "ssh-agent"
+const noPassphraseFlag = "no-passphrase"
+
+// A path of "-" means stdin when dropping and stdout when pulling, so objects can be piped without temporary files.
+const stdioPath = "-"
 
 var confFile string
 var keyNameRegex = regexp.MustCompile(lib.KeyNameRegex)
+var errIntegrity = fmt.Errorf("object integrity compromised, discarding unsafe pull")
 
 func main() {
 	cobra.OnInitialize(loadConfig)
 
 	var rootCmd = &cobra.Command{Use: "dead"}
-	rootCmd.AddCommand(setupDropCmd(), setupPullCmd(), setupAddKeyCmd(), setupKeyGenCmd())
+	rootCmd.AddCommand(
+		setupDropCmd(), setupPullCmd(), setupStatusCmd(), setupRevokeCmd(), setupAddKeyCmd(), setupKeyGenCmd(), setupKeyCmd(),
+	)
 
 	rootCmd.PersistentFlags().StringVar(&confFile, "config", "",
 		"config file (default is "+filepath.Join("$HOME", lib.DefaultConfigDir, lib.DefaultConfigName)+".yml)")
 
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Printf("FATAL: Failed to execute command: %v\n", err)
+		fmt.Fprintf(os.Stderr, "FATAL: Failed to execute command: %v\n", err)
 		os.Exit(1)
 	}
 }
@@ -58,7 +78,7 @@ func loadConfig() {
 	}
 
 	if err := viper.ReadInConfig(); err != nil {
-		fmt.Printf("Error reading config file: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error reading config file: %v\n", err)
 		os.Exit(1)
 	}
 }
@@ -74,7 +94,7 @@ func getStringFlag(flag string) (string, error) {
 
 func bindPFlag(cmd *cobra.Command, flag string) {
 	if err := viper.BindPFlag(flag, cmd.PersistentFlags().Lookup(flag)); err != nil {
-		fmt.Printf("Error binding %s flag for the %s command: %v\n", flag, cmd.Name(), err)
+		fmt.Fprintf(os.Stderr, "Error binding %s flag for the %s command: %v\n", flag, cmd.Name(), err)
 	}
 }
 
@@ -91,6 +111,8 @@ func setupRemoteCmdFlags(cmd *cobra.Command) {
 	cmd.PersistentFlags().String(privKeyFlag, "",
 		"Private key to use for authentication (e.g. generated by keygen)")
 	cmd.PersistentFlags().String(keyNameFlag, "", "Key name to use for authentication")
+	cmd.PersistentFlags().Bool(sshAgentFlag, false,
+		"Authenticate with the key in ssh-agent whose comment is the key name, instead of the private key")
 	cmd.PersistentFlags().Bool(insecureSkipVerifyFlag, false, "Skip tls certificate verification")
 }
 
@@ -98,60 +120,99 @@ func bindRemoteCmdFlags(cmd *cobra.Command) {
 	bindPFlag(cmd, remoteFlag)
 	bindPFlag(cmd, privKeyFlag)
 	bindPFlag(cmd, keyNameFlag)
+	bindPFlag(cmd, sshAgentFlag)
 	bindPFlag(cmd, insecureSkipVerifyFlag)
 
 	insecureSkipVerify := viper.GetBool(insecureSkipVerifyFlag)
 	if insecureSkipVerify {
-		fmt.Printf("WARN: Skipping tls certificate verification, be careful!\n")
+		fmt.Fprintf(os.Stderr, "WARN: Skipping tls certificate verification, be careful!\n")
 	}
 	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: insecureSkipVerify}
 }
 
 func setupDropCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "drop <file path>",
-		Short: "Drop a file to remote",
+		Use:   "drop <file path>... | -",
+		Short: "Drop files or directories to remote",
 		Args:  cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			filePath := args[0]
+			filePath := strings.Join(args, " ")
 
 			bindRemoteCmdFlags(cmd)
 			bindEncryptionFlags(cmd)
-
-			or, err := drop(filePath)
+			bindPFlag(cmd, ttlFlag)
+			bindPFlag(cmd, maxPullsFlag)
+			bindPFlag(cmd, recipientFlag)
+			bindPFlag(cmd, sharedKeyFlag)
+			bindPFlag(cmd, capabilityFlag)
+			bindPFlag(cmd, passphraseFlag)
+			bindPFlag(cmd, cipherFlag)
+			bindPFlag(cmd, noteFlag)
+			bindPFlag(cmd, compressFlag)
+
+			or, err := drop(args)
 			if err != nil {
-				fmt.Printf("ERROR: Failed to drop file '%s': %v\n", filePath, err)
+				fmt.Fprintf(os.Stderr, "ERROR: Failed to drop file '%s': %v\n", filePath, err)
 				os.Exit(1)
 			}
 
-			fmt.Printf("Dropped %s -> %s\n", filePath, or)
+			// Only the reference is written to stdout, so it can be captured by scripts.
+			fmt.Fprintf(os.Stderr, "Dropped %s -> ", filePath)
+			fmt.Printf("%s\n", or)
+			if or.key != nil {
+				fmt.Fprintf(os.Stderr, "WARN: The reference contains the key of the object, only share it with the recipient\n")
+			}
 		},
 	}
 
 	setupRemoteCmdFlags(cmd)
 	setupEncryptionFlags(cmd)
+	cmd.PersistentFlags().Duration(ttlFlag, 0,
+		"How long the object should live on remote (e.g. 15m, 48h), capped by the server (default is the server default)")
+	cmd.PersistentFlags().Int(maxPullsFlag, -1,
+		"Number of pulls after which the object is destroyed, 0 for unlimited pulls (-1 uses the server default)")
+	cmd.PersistentFlags().StringSlice(recipientFlag, nil,
+		"Public key of a recipient (e.g. generated by gen-key) to encrypt the object for, instead of the encryption key")
+	cmd.PersistentFlags().StringSlice(sharedKeyFlag, nil,
+		"Encryption key shared with a recipient to encrypt the object for, which can be combined with --"+recipientFlag)
+	cmd.PersistentFlags().Bool(capabilityFlag, false,
+		"Encrypt the object with a random key, which is included in the printed reference so no key needs to be shared")
+	cmd.PersistentFlags().Bool(passphraseFlag, false,
+		"Encrypt the object with a passphrase, which is prompted for on the terminal")
+	cmd.PersistentFlags().String(cipherFlag, cipherSuites[aes256GCMSuite].name,
+		"Cipher to encrypt the object with, one of AES-256-GCM or XChaCha20-Poly1305")
+	cmd.PersistentFlags().String(noteFlag, "", "Note for the recipient, which is encrypted along with the object")
+	cmd.PersistentFlags().String(compressFlag, "",
+		"Compress the object before encrypting it (gzip), which leaks how compressible it is through its size")
 
 	return cmd
 }
 
 func setupPullCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "pull <object> <destination path>",
+		Use:   "pull <object> [destination path | -]",
 		Short: "Pull a dropped object from remote",
-		Args:  cobra.MinimumNArgs(2),
+		Args:  cobra.RangeArgs(1, 2),
 		Run: func(cmd *cobra.Command, args []string) {
 			object := args[0]
-			destPath := args[1]
+
+			// Without a destination, files are restored under their original name, and archives into the working
+			// directory.
+			destPath := ""
+			if len(args) > 1 {
+				destPath = args[1]
+			}
 
 			bindRemoteCmdFlags(cmd)
 			bindEncryptionFlags(cmd)
 
-			if err := pull(object, destPath); err != nil {
-				fmt.Printf("ERROR: Failed to pull object '%s': %v\n", object, err)
+			destPath, err := pull(object, destPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: Failed to pull object '%s': %v\n", object, err)
 				os.Exit(1)
 			}
 
-			fmt.Printf("Pulled %s <- %s\n", destPath, object)
+			fmt.Fprintf(os.Stderr, "Pulled %s <- %s\n", destPath, object)
 		},
 	}
 
@@ -161,6 +222,52 @@ func setupPullCmd() *cobra.Command {
 	return cmd
 }
 
+func setupStatusCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "status <object>",
+		Short: "Check whether a dropped object is still waiting on remote, without pulling it",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			object := args[0]
+
+			bindRemoteCmdFlags(cmd)
+
+			if err := status(object); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: Failed to get status of object '%s': %v\n", object, err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	setupRemoteCmdFlags(cmd)
+
+	return cmd
+}
+
+func setupRevokeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "revoke <object>",
+		Short: "Destroy a dropped object on remote before it is pulled, only allowed for the key that dropped it",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			object := args[0]
+
+			bindRemoteCmdFlags(cmd)
+
+			if err := revoke(object); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: Failed to revoke object '%s': %v\n", object, err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Revoked %s\n", object)
+		},
+	}
+
+	setupRemoteCmdFlags(cmd)
+
+	return cmd
+}
+
 func setupAddKeyCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "add-key <public key path> <key name>",
@@ -173,7 +280,7 @@ func setupAddKeyCmd() *cobra.Command {
 			bindRemoteCmdFlags(cmd)
 
 			if err := addKey(pubKeyPath, keyName); err != nil {
-				fmt.Printf("ERROR: Failed to add authorized key '%s': %v\n", pubKeyPath, err)
+				fmt.Fprintf(os.Stderr, "ERROR: Failed to add authorized key '%s': %v\n", pubKeyPath, err)
 				os.Exit(1)
 			}
 
@@ -187,28 +294,96 @@ func setupAddKeyCmd() *cobra.Command {
 }
 
 func setupKeyGenCmd() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "gen-key <private key path> <public key path>",
-		Short: "Generates an RSA key-pair, for use authenticating requests",
+		Short: "Generates a key-pair, for use authenticating requests and receiving objects",
 		Args:  cobra.MinimumNArgs(2),
 		Run: func(cmd *cobra.Command, args []string) {
 			privPath := args[0]
 			pubPath := args[1]
 
-			if err := keyGen(privPath, pubPath); err != nil {
-				fmt.Printf("ERROR: Failed to generate key-pair: %v\n", err)
+			bindPFlag(cmd, keyTypeFlag)
+			bindPFlag(cmd, noPassphraseFlag)
+
+			var passphrase *memguard.LockedBuffer
+			if !viper.GetBool(noPassphraseFlag) {
+				var err error
+				passphrase, err = readNewPassphrase("Enter passphrase for the private key: ")
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: Failed to read passphrase (see --%s): %v\n", noPassphraseFlag, err)
+					os.Exit(1)
+				}
+				defer passphrase.Destroy()
+			}
+
+			if err := keyGen(privPath, pubPath, viper.GetString(keyTypeFlag), passphrase); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: Failed to generate key-pair: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.PersistentFlags().String(keyTypeFlag, rsaKeyType, "type of key to generate (rsa, ed25519, or ecdsa)")
+	cmd.PersistentFlags().Bool(noPassphraseFlag, false, "Write the private key unencrypted, without a passphrase")
+
+	return cmd
+}
+
+func setupKeyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "key",
+		Short: "Manages private keys",
+	}
+
+	cmd.AddCommand(setupChangePassphraseCmd())
+
+	return cmd
+}
+
+func setupChangePassphraseCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "change-passphrase <private key path>",
+		Short: "Changes the passphrase of a private key generated by gen-key, or adds one",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			bindPFlag(cmd, noPassphraseFlag)
+
+			privKeyPath, err := homedir.Expand(args[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: Failed to locate private key: %v\n", err)
+				os.Exit(1)
+			}
+
+			newPassphrase := func() (*memguard.LockedBuffer, error) {
+				return readNewPassphrase("Enter new passphrase: ")
+			}
+			if viper.GetBool(noPassphraseFlag) {
+				newPassphrase = nil
+			}
+
+			if err := changePassphrase(privKeyPath, readPassphrase, newPassphrase); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: Failed to change passphrase: %v\n", err)
 				os.Exit(1)
 			}
+
+			if newPassphrase == nil {
+				fmt.Printf("Removed passphrase of %s\n", privKeyPath)
+			} else {
+				fmt.Printf("Changed passphrase of %s\n", privKeyPath)
+			}
 		},
 	}
+
+	cmd.PersistentFlags().Bool(noPassphraseFlag, false, "Remove the passphrase, leaving the private key unencrypted")
+
+	return cmd
 }
 
-func checksum(data []byte) string {
-	checksumBytes := sha256.Sum256(data)
-	return base64.URLEncoding.EncodeToString(checksumBytes[:])
+func checksum(digest hash.Hash) string {
+	return base64.URLEncoding.EncodeToString(digest.Sum(nil))
 }
 
-func loadEncryptionKey(rawPath string) (*memguard.LockedBuffer, error) {
+func loadEncryptionKey(rawPath string) (*SharedKey, error) {
 	encryptionKeyPath, err := homedir.Expand(rawPath)
 	if err != nil {
 		return nil, fmt.Errorf("error locating encryption key: %v", err)
@@ -218,16 +393,45 @@ func loadEncryptionKey(rawPath string) (*memguard.LockedBuffer, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error reading encryption key '%s': %v", encryptionKeyPath, err)
 	}
-	encryptionKey := memguard.NewBufferFromEntireReader(encryptionKeyReader)
+	defer encryptionKeyReader.Close()
 
-	return encryptionKey, nil
+	return newSharedKey(memguard.NewBufferFromEntireReader(encryptionKeyReader)), nil
 }
 
-// TODO(shane) this function is quite long, try to split it up.
-func drop(filePath string) (*ObjectReference, error) {
-	remote, err := getStringFlag(remoteFlag)
-	if err != nil {
-		return nil, err
+// Objects are encrypted for the given recipients if there are any, and otherwise with the shared encryption key.
+// A capability reference is also a recipient, so that its key can open the object.
+func loadSealer(or *ObjectReference, suite *CipherSuite) (func(dst io.Writer, src io.Reader) error, error) {
+	recipients := make([]Recipient, 0)
+	if or.key != nil {
+		recipients = append(recipients, or.sharedKey())
+	}
+	for _, pubKeyPath := range viper.GetStringSlice(recipientFlag) {
+		recipient, err := loadRecipient(pubKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+	for _, sharedKeyPath := range viper.GetStringSlice(sharedKeyFlag) {
+		sharedKey, err := loadEncryptionKey(sharedKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, sharedKey)
+	}
+	if viper.GetBool(passphraseFlag) {
+		passphrase, err := readNewPassphrase("Enter passphrase: ")
+		if err != nil {
+			return nil, fmt.Errorf("error reading passphrase: %v", err)
+		}
+		recipients = append(recipients, &PassphraseRecipient{passphrase: passphrase})
+	}
+
+	if len(recipients) > 0 {
+		return func(dst io.Writer, src io.Reader) error {
+			defer destroyRecipients(recipients)
+			return encryptEnvelope(recipients, suite, dst, src)
+		}, nil
 	}
 
 	encryptionKeyRawPath, err := getStringFlag(encryptionKeyFlag)
@@ -235,69 +439,164 @@ func drop(filePath string) (*ObjectReference, error) {
 		return nil, err
 	}
 
-	data, err := ioutil.ReadFile(filePath)
+	encryptionKey, err := loadEncryptionKey(encryptionKeyRawPath)
 	if err != nil {
-		return nil, fmt.Errorf("error reading file '%s': %v", filePath, err)
+		return nil, err
 	}
 
-	fmt.Printf("Encrypting object with AES-CTR + HMAC-SHA-265 ...\n")
+	return func(dst io.Writer, src io.Reader) error {
+		defer encryptionKey.destroy()
+		return encrypt(encryptionKey, suite, dst, src)
+	}, nil
+}
 
-	encryptionKey, err := loadEncryptionKey(encryptionKeyRawPath)
+// The keyring holds the shared encryption key if one is configured, and the private key used for authentication,
+// which can open objects dropped for its public key.
+func loadKeyring(or *ObjectReference) (*Keyring, error) {
+	keyring := &Keyring{}
+
+	if or.key != nil {
+		keyring.identities = append(keyring.identities, or.sharedKey())
+	}
+
+	if encryptionKeyRawPath := viper.GetString(encryptionKeyFlag); encryptionKeyRawPath != "" {
+		encryptionKey, err := loadEncryptionKey(encryptionKeyRawPath)
+		if err != nil {
+			return nil, err
+		}
+		keyring.sharedKey = encryptionKey
+		keyring.identities = append(keyring.identities, encryptionKey)
+	}
+
+	if privKeyRawPath := viper.GetString(privKeyFlag); privKeyRawPath != "" {
+		privKey, err := loadPrivateKey(privKeyRawPath)
+		if err != nil {
+			return nil, err
+		}
+		// Keys on curves that cannot agree on a key (e.g. P-224) can still authenticate, just not open objects.
+		if identity, err := newIdentity(privKey); err == nil {
+			keyring.identities = append(keyring.identities, identity)
+		}
+	}
+
+	// The passphrase is only prompted for if none of the other keys can open the object.
+	keyring.identities = append(keyring.identities, &PassphraseIdentity{prompt: readPassphrase})
+
+	return keyring, nil
+}
+
+// TODO(shane) this function is quite long, try to split it up.
+func drop(paths []string) (*ObjectReference, error) {
+	remote, err := getStringFlag(remoteFlag)
 	if err != nil {
 		return nil, err
 	}
 
-	data, err = encrypt(encryptionKey, data)
-	if err != nil {
-		return nil, fmt.Errorf("error encrypting object: %v", err)
+	ttl := viper.GetDuration(ttlFlag)
+	if ttl < 0 {
+		return nil, fmt.Errorf("ttl must not be negative")
 	}
 
-	remoteUrl := fmt.Sprintf("%s/d", remote)
+	if err = checkPayloadPaths(paths); err != nil {
+		return nil, err
+	}
 
-	client := &http.Client{}
+	header := &PayloadHeader{
+		Note:        viper.GetString(noteFlag),
+		Compression: viper.GetString(compressFlag),
+	}
+	if len(header.Note) > maxNoteLength {
+		return nil, fmt.Errorf("note must not be longer than %d bytes", maxNoteLength)
+	}
+	if err = checkCompression(header.Compression); err != nil {
+		return nil, err
+	}
+	if header.Compression != noCompression {
+		fmt.Fprintf(os.Stderr, compressionWarning)
+	}
+
+	or := &ObjectReference{}
+	if viper.GetBool(capabilityFlag) {
+		or.key = memguard.NewBufferRandom(capabilityKeyLength)
+	}
+
+	suite, err := parseCipherSuite(viper.GetString(cipherFlag))
+	if err != nil {
+		return nil, err
+	}
 
-	req, err := http.NewRequest("POST", remoteUrl, bytes.NewReader(data))
+	seal, err := loadSealer(or, suite)
 	if err != nil {
-		return nil, fmt.Errorf("error building request: %v", err)
+		return nil, err
 	}
 
-	req.Header.Set("Content-Type", "application/octet-stream")
+	fmt.Fprintf(os.Stderr, "Encrypting and uploading object with %s ...\n", suite.name)
 
-	fmt.Printf("Uploading object ...\n")
+	// The payload is packed as it is encrypted, and encrypted as it is uploaded, so only a single chunk is ever held in
+	// memory.
+	payload, payloadWriter := io.Pipe()
+	go func() {
+		payloadWriter.CloseWithError(writePayload(paths, header, payloadWriter))
+	}()
 
-	resp, err := makeAuthenticatedRequest(client, req, remote)
+	body, bodyWriter := io.Pipe()
+	digest := sha256.New()
+	encryptErr := make(chan error, 1)
+	go func() {
+		err := seal(io.MultiWriter(digest, bodyWriter), payload)
+		payload.Close()
+		bodyWriter.CloseWithError(err)
+		encryptErr <- err
+	}()
+
+	client := &http.Client{}
+
+	resp, err := upload(client, remote, body, dropHeader(ttl, viper.GetInt(maxPullsFlag)))
 	if err != nil {
+		body.Close()
 		return nil, err
 	}
+	defer resp.Body.Close()
+
+	if err = <-encryptErr; err != nil {
+		return nil, fmt.Errorf("error encrypting object: %v", err)
+	}
+
+	if ttlSec, err := strconv.ParseInt(resp.Header.Get(lib.TTLHeader), 10, 64); err == nil {
+		effectiveTTL := time.Duration(ttlSec) * time.Second
+		if ttl > effectiveTTL {
+			fmt.Fprintf(os.Stderr, "WARN: Requested ttl exceeds the remote maximum, object will expire after %v\n", effectiveTTL)
+		}
+	}
 
 	oid, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("error reading response body: %v", err)
 	}
 
-	or := &ObjectReference{
-		oid:      string(oid),
-		checksum: checksum(data),
-	}
+	or.oid = string(oid)
+	or.checksum = checksum(digest)
 	return or, nil
 }
 
 // TODO(shane) this function is quite long, try to split it up.
-func pull(object string, destPath string) error {
+func pull(object string, destPath string) (string, error) {
 	or, err := parseObjectReference(object)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	remote, err := getStringFlag(remoteFlag)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	encryptionKeyRawPath, err := getStringFlag(encryptionKeyFlag)
+	// Keys are loaded before pulling, since the pull may destroy the object.
+	keyring, err := loadKeyring(or)
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer keyring.destroy()
 
 	remoteUrl := fmt.Sprintf("%s/d/%s", remote, or.oid)
 
@@ -305,47 +604,277 @@ func pull(object string, destPath string) error {
 
 	req, err := http.NewRequest("GET", remoteUrl, nil)
 	if err != nil {
-		return fmt.Errorf("error building request: %v", err)
+		return "", fmt.Errorf("error building request: %v", err)
 	}
 
-	fmt.Printf("Downloading object ...\n")
-
 	resp, err := makeAuthenticatedRequest(client, req, remote)
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer resp.Body.Close()
 
-	data, err := ioutil.ReadAll(resp.Body)
+	// The object is decrypted as it is downloaded, and its payload is unpacked as it is decrypted.
+	plaintext, plaintextWriter := io.Pipe()
+	defer plaintext.Close()
+	go func() {
+		plaintextWriter.CloseWithError(decryptPull(keyring, or, plaintextWriter, resp.Body))
+	}()
+
+	payload, err := readPayloadHeader(plaintext)
 	if err != nil {
-		return fmt.Errorf("error reading response body: %v", err)
+		return "", err
+	}
+	if payload.Note != "" {
+		fmt.Fprintf(os.Stderr, "Note: %s\n", sanitizeNote(payload.Note))
 	}
 
-	fmt.Printf("Verifying checksum ...\n")
-	if checksum(data) != or.checksum {
-		return fmt.Errorf("object integrity compromised, discarding unsafe pull")
+	// Decompression reads the plaintext to its end, so the whole object is still verified.
+	body, err := decompressPayload(payload.Compression, plaintext)
+	if err != nil {
+		return "", fmt.Errorf("error decompressing object: %v", err)
 	}
+	defer body.Close()
 
-	fmt.Printf("Decrypting object with AES-CTR + HMAC-SHA-265 ...\n")
+	// Plaintext written to stdout cannot be staged, so it is written as each chunk is authenticated, and a failed
+	// checksum is only reported (with a non-zero exit) once the whole object has been written.
+	// Archives are written to stdout as is, so they can be piped to tar.
+	if destPath == stdioPath {
+		if _, err = io.Copy(os.Stdout, body); err == errIntegrity {
+			return "", fmt.Errorf("object integrity compromised, the data written to stdout must be discarded")
+		}
+		return destPath, err
+	}
 
-	encryptionKey, err := loadEncryptionKey(encryptionKeyRawPath)
+	switch payload.Type {
+	case filePayload:
+		return pullFile(body, payload, destPath)
+	case archivePayload:
+		if destPath == "" {
+			destPath = "."
+		}
+		return destPath, pullArchive(body, destPath)
+	default:
+		return "", fmt.Errorf("unsupported payload type '%s'", payload.Type)
+	}
+}
+
+// Plaintext is staged next to the destination, and only moved into place once the whole object is verified.
+// Files restored under their original name never replace an existing file.
+func pullFile(plaintext io.Reader, payload *PayloadHeader, destPath string) (string, error) {
+	restore := destPath == ""
+	if restore {
+		name, err := restoredName(payload.Name)
+		if err != nil {
+			return "", err
+		}
+		destPath = name
+	}
+
+	destDir, destName := filepath.Split(destPath)
+	if destDir == "" {
+		destDir = "."
+	}
+	staged, err := ioutil.TempFile(destDir, "."+destName+".part")
+	if err != nil {
+		return "", fmt.Errorf("error creating '%s': %v", destPath, err)
+	}
+	defer os.Remove(staged.Name())
+	defer staged.Close()
+
+	size, err := io.Copy(staged, plaintext)
+	if err != nil {
+		return "", err
+	}
+	if payload.Size != nil && size != *payload.Size {
+		return "", fmt.Errorf("object size does not match the size it was dropped with")
+	}
+
+	mode := restoredMode(destName, payload.Mode)
+	if isPrivateName(payload.Name) {
+		mode = restoredMode(payload.Name, mode)
+	}
+	if err = staged.Chmod(mode); err != nil {
+		return "", fmt.Errorf("error writing object to '%s': %v", destPath, err)
+	}
+	if err = staged.Close(); err != nil {
+		return "", fmt.Errorf("error writing object to '%s': %v", destPath, err)
+	}
+	if payload.ModTime != nil {
+		if err = os.Chtimes(staged.Name(), *payload.ModTime, *payload.ModTime); err != nil {
+			return "", fmt.Errorf("error writing object to '%s': %v", destPath, err)
+		}
+	}
+
+	if restore {
+		// Linking fails if the destination exists, unlike renaming.
+		if err = os.Link(staged.Name(), destPath); os.IsExist(err) {
+			return "", fmt.Errorf("'%s' already exists, pass a destination path to pull the object elsewhere", destPath)
+		} else if err != nil {
+			return "", fmt.Errorf("error writing object to '%s': %v", destPath, err)
+		}
+		return destPath, nil
+	}
+
+	if err = os.Rename(staged.Name(), destPath); err != nil {
+		return "", fmt.Errorf("error writing object to '%s': %v", destPath, err)
+	}
+	return destPath, nil
+}
+
+// Archives are unpacked into a staging directory next to the destination directory, and their entries are only moved
+// into place once the whole object is verified. Existing files in the destination are never overwritten.
+func pullArchive(plaintext io.Reader, destPath string) error {
+	destPath = filepath.Clean(destPath)
+	destDir, destName := filepath.Split(destPath)
+	if destName == "." || destName == ".." {
+		// The destination is the working directory or its parent, so the archive is staged inside of it.
+		destDir, destName = destPath, "dead-drop"
+	}
+	if destDir == "" {
+		destDir = "."
+	}
+	staged, err := ioutil.TempDir(destDir, "."+destName+".part")
 	if err != nil {
+		return fmt.Errorf("error creating '%s': %v", destPath, err)
+	}
+	defer os.RemoveAll(staged)
+
+	if err = unpackArchive(plaintext, staged); err != nil {
+		return fmt.Errorf("error unpacking archive: %v", err)
+	}
+
+	// The archive may end before the object does, so the rest is read to finish verifying the object.
+	if _, err = io.Copy(ioutil.Discard, plaintext); err != nil {
 		return err
 	}
 
-	dataBuf, err := decrypt(encryptionKey, data)
+	if _, err = os.Stat(destPath); os.IsNotExist(err) {
+		if err = os.Rename(staged, destPath); err != nil {
+			return fmt.Errorf("error writing archive to '%s': %v", destPath, err)
+		}
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(staged)
 	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, err := os.Lstat(filepath.Join(destPath, entry.Name())); !os.IsNotExist(err) {
+			return fmt.Errorf("'%s' already exists", filepath.Join(destPath, entry.Name()))
+		}
+	}
+	for _, entry := range entries {
+		if err = os.Rename(filepath.Join(staged, entry.Name()), filepath.Join(destPath, entry.Name())); err != nil {
+			return fmt.Errorf("error writing archive to '%s': %v", destPath, err)
+		}
+	}
+
+	return nil
+}
+
+// Decrypts a pulled object, and verifies that it is the object the reference was made for.
+func decryptPull(keyring *Keyring, or *ObjectReference, dst io.Writer, src io.Reader) error {
+	fmt.Fprintf(os.Stderr, "Downloading and decrypting object ...\n")
+
+	digest := sha256.New()
+	if err := decrypt(keyring, dst, io.TeeReader(src, digest)); err != nil {
 		return fmt.Errorf("error decrypting object: %v", err)
 	}
-	defer dataBuf.Destroy()
-	data = dataBuf.Bytes()
 
-	if err = ioutil.WriteFile(destPath, data, lib.ObjectPerms); err != nil {
-		return fmt.Errorf("error writing object to '%s': %v", destPath, err)
+	fmt.Fprintf(os.Stderr, "Verifying checksum ...\n")
+	if checksum(digest) != or.checksum {
+		return errIntegrity
+	}
+
+	return nil
+}
+
+func status(object string) error {
+	or, err := parseObjectReference(object)
+	if err != nil {
+		return err
+	}
+
+	remote, err := getStringFlag(remoteFlag)
+	if err != nil {
+		return err
+	}
+
+	remoteUrl := fmt.Sprintf("%s/d/%s", remote, or.oid)
+
+	client := &http.Client{}
+
+	req, err := http.NewRequest("HEAD", remoteUrl, nil)
+	if err != nil {
+		return fmt.Errorf("error building request: %v", err)
+	}
+
+	resp, err := makeAuthenticatedRequest(client, req, remote)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		fmt.Printf("Object %s is gone (it was pulled, expired, or never existed)\n", or.oid)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	ttlSec, err := strconv.ParseInt(resp.Header.Get(lib.TTLHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("error reading remaining ttl: %v", err)
+	}
+	maxPulls, err := strconv.ParseUint(resp.Header.Get(lib.MaxPullsHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("error reading pull limit: %v", err)
+	}
+
+	pulls := "unlimited"
+	if maxPulls != 0 {
+		pulls = fmt.Sprintf("%s of %d", resp.Header.Get(lib.PullsRemainingHeader), maxPulls)
 	}
 
+	fmt.Printf("Object %s is waiting on remote\n", or.oid)
+	fmt.Printf("  Size: %d bytes\n", resp.ContentLength)
+	fmt.Printf("  Expires in: %v\n", time.Duration(ttlSec)*time.Second)
+	fmt.Printf("  Pulls remaining: %s\n", pulls)
+
 	return nil
 }
 
+func revoke(object string) error {
+	or, err := parseObjectReference(object)
+	if err != nil {
+		return err
+	}
+
+	remote, err := getStringFlag(remoteFlag)
+	if err != nil {
+		return err
+	}
+
+	remoteUrl := fmt.Sprintf("%s/d/%s", remote, or.oid)
+
+	client := &http.Client{}
+
+	req, err := http.NewRequest("DELETE", remoteUrl, nil)
+	if err != nil {
+		return fmt.Errorf("error building request: %v", err)
+	}
+
+	resp, err := makeAuthenticatedRequest(client, req, remote)
+	if resp != nil {
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return fmt.Errorf("object is gone (it was pulled, expired, or never existed)")
+		case http.StatusForbidden:
+			return fmt.Errorf("object was dropped with a different key")
+		}
+	}
+	return err
+}
+
 func addKey(pubKeyPath string, keyName string) error {
 	remote, err := getStringFlag(remoteFlag)
 	if err != nil {
@@ -380,28 +909,34 @@ func addKey(pubKeyPath string, keyName string) error {
 	return err
 }
 
-func keyGen(privPath string, pubPath string) error {
-	privKey, err := rsa.GenerateKey(rand.Reader, 4096)
+// The private key is encrypted with the passphrase, unless it is nil.
+func keyGen(privPath string, pubPath string, keyType string, passphrase *memguard.LockedBuffer) error {
+	privKey, err := generateKey(keyType)
 	if err != nil {
 		return fmt.Errorf("failed generating private key: %v", err)
 	}
 
-	privKeyBytes := pem.EncodeToMemory(&pem.Block{
-		Type:    "RSA PRIVATE KEY",
-		Headers: nil,
-		Bytes:   x509.MarshalPKCS1PrivateKey(privKey),
-	})
+	privKeyDer, err := marshalPrivateKey(privKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode private key: %v", err)
+	}
+	if passphrase != nil {
+		if privKeyDer, err = encryptPrivateKey(privKeyDer, passphrase); err != nil {
+			return fmt.Errorf("failed to encrypt private key: %v", err)
+		}
+	}
+	privKeyBytes := pem.EncodeToMemory(privKeyDer)
 
 	if err := ioutil.WriteFile(privPath, privKeyBytes, lib.PrivateKeyPerms); err != nil {
 		return fmt.Errorf("failed to write private key: %v", err)
 	}
 	fmt.Printf("Wrote private key to %s\n", privPath)
 
-	pubKeyBytes := pem.EncodeToMemory(&pem.Block{
-		Type:    "RSA PUBLIC KEY",
-		Headers: nil,
-		Bytes:   x509.MarshalPKCS1PublicKey(&privKey.PublicKey),
-	})
+	pubKeyDer, err := marshalPublicKey(privKey.Public())
+	if err != nil {
+		return fmt.Errorf("failed to encode public key: %v", err)
+	}
+	pubKeyBytes := pem.EncodeToMemory(pubKeyDer)
 
 	if err := ioutil.WriteFile(pubPath, pubKeyBytes, lib.PublicKeyPerms); err != nil {
 		return fmt.Errorf("failed to write public key: %v", err)
@@ -433,21 +968,45 @@ func makeAuthenticatedRequestInternal(client *http.Client, req *http.Request, re
 		return nil, fmt.Errorf("invalid key name")
 	}
 
+	signer, err := loadSigner(keyName)
+	if err != nil {
+		return nil, err
+	}
+
+	contentHash, err := requestContentHash(req)
+	if err != nil {
+		return nil, err
+	}
+
 	for i := 0; true; i++ {
-		token, err := authenticate(remote, keyName)
-		if err != nil {
+		nonce, err := nonces.take(client, remote)
+		if _, isNetworkErr := err.(*url.Error); isNetworkErr {
+			// Left unwrapped, so that callers can tell a network error from a rejection and retry it.
+			return nil, err
+		} else if err != nil {
 			return nil, fmt.Errorf("authentication failed: %v", err)
 		}
 
-		req.Header.Set("Authorization", token)
+		if err := signRequest(req, signer, keyName, nonce, contentHash); err != nil {
+			return nil, fmt.Errorf("authentication failed: %v", err)
+		}
 
 		resp, err := client.Do(req)
 		if err != nil {
 			return nil, err
 		}
+		nonces.put(remote, resp.Header.Get(lib.NonceHeader))
+
+		// Signed request bodies are always replayable (see requestContentHash), so any request can be retried.
 		if resp.StatusCode == http.StatusUnauthorized && i < 1 {
-			// If we get here it is because the JWT secret rotated between the two requests.
-			// This happens infrequently, so retrying will succeed.
+			// If we get here it is because the nonce expired, or the server's secret rotated since it was issued.
+			// This happens infrequently, so retrying with a fresh nonce will succeed.
+			resp.Body.Close()
+			if req.GetBody != nil {
+				if req.Body, err = req.GetBody(); err != nil {
+					return nil, err
+				}
+			}
 			continue
 		}
 
@@ -457,56 +1016,3 @@ func makeAuthenticatedRequestInternal(client *http.Client, req *http.Request, re
 	// Unreachable.
 	return nil, nil
 }
-
-func authenticate(remote string, keyName string) (string, error) {
-	rawPrivKeyPath, err := getStringFlag(privKeyFlag)
-	if err != nil {
-		return "", err
-	}
-	privKeyPath, err := homedir.Expand(rawPrivKeyPath)
-	if err != nil {
-		return "", fmt.Errorf("error locating private key: %v\n", err)
-	}
-
-	remoteUrl := fmt.Sprintf("%s/token", remote)
-
-	payload := lib.TokenRequestPayload{
-		KeyName: keyName,
-	}
-
-	body := new(bytes.Buffer)
-	if err := json.NewEncoder(body).Encode(payload); err != nil {
-		return "", err
-	}
-
-	resp, err := http.Post(remoteUrl, "application/json", body)
-	if err != nil {
-		return "", err
-	}
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("response status: %s\n", resp.Status)
-	}
-
-	ciphertext, err := ioutil.ReadAll(resp.Body)
-
-	privKeyBytes, err := ioutil.ReadFile(privKeyPath)
-	if err != nil {
-		return "", fmt.Errorf("error reading private key '%s': %v", privKeyPath, err)
-	}
-
-	privKeyDer, _ := pem.Decode(privKeyBytes)
-	if privKeyDer == nil {
-		return "", fmt.Errorf("failed to decode pem bytes\n")
-	}
-	privKey, err := x509.ParsePKCS1PrivateKey(privKeyDer.Bytes)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse private key: %v\n", err)
-	}
-
-	token, err := rsa.DecryptOAEP(sha512.New(), rand.Reader, privKey, ciphertext, []byte(lib.TokenCipherLabel))
-	if err != nil {
-		return "", fmt.Errorf("failed to decrypt authorization token: %v\n", err)
-	}
-
-	return string(token), nil
-}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Payloads may be compressed before they are encrypted, which is recorded in the (encrypted) payload header.
+// Compression is off by default, since the size of a compressed object leaks how compressible its contents are, which
+// can reveal secrets that are dropped along with data an attacker can influence (e.g. CRIME and BREACH).
+const noCompression = ""
+const gzipCompression = "gzip"
+
+const compressionWarning = "WARN: Compressed objects leak how compressible their contents are through their size, " +
+	"don't compress secrets along with data others can influence\n"
+
+func checkCompression(compression string) error {
+	switch compression {
+	case noCompression, gzipCompression:
+		return nil
+	default:
+		return fmt.Errorf("unsupported compression '%s'", compression)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// The returned writer must be closed to flush the compressed payload, but does not close dst.
+func compressPayload(compression string, dst io.Writer) (io.WriteCloser, error) {
+	switch compression {
+	case noCompression:
+		return nopWriteCloser{dst}, nil
+	case gzipCompression:
+		return gzip.NewWriter(dst), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression '%s'", compression)
+	}
+}
+
+func decompressPayload(compression string, src io.Reader) (io.ReadCloser, error) {
+	switch compression {
+	case noCompression:
+		return ioutil.NopCloser(src), nil
+	case gzipCompression:
+		return gzip.NewReader(src)
+	default:
+		return nil, fmt.Errorf("unsupported compression '%s'", compression)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"math/big"
+)
+
+const ecdhStanza = 4
+
+const ecdhWrapLabel = "dead-drop ecdh wrap"
+
+// The content key is sealed under a key agreed between a fresh ephemeral key and the recipient's key, derived with
+// HKDF over the shared secret and both public keys. The stanza holds the ephemeral public key, followed by the sealed
+// content key. Ed25519 keys agree on X25519 keys (as OpenSSH and age do), and ECDSA keys on their own curve.
+type ECDHRecipient struct {
+	pubKey *ecdh.PublicKey
+}
+
+func newECDHRecipient(pubKey crypto.PublicKey) (*ECDHRecipient, error) {
+	switch pubKey := pubKey.(type) {
+	case ed25519.PublicKey:
+		x25519Key, err := ed25519PublicKeyToX25519(pubKey)
+		if err != nil {
+			return nil, err
+		}
+		return &ECDHRecipient{pubKey: x25519Key}, nil
+	case *ecdsa.PublicKey:
+		ecdhKey, err := pubKey.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		return &ECDHRecipient{pubKey: ecdhKey}, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key algorithm %T", pubKey)
+	}
+}
+
+func (recipient *ECDHRecipient) wrap(contentKey *memguard.LockedBuffer) (*Stanza, error) {
+	ephemeralKey, err := recipient.pubKey.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ephemeral key: %v", err)
+	}
+
+	sharedSecret, err := ephemeralKey.ECDH(recipient.pubKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to agree on key: %v", err)
+	}
+
+	ephemeralPubKey := ephemeralKey.PublicKey().Bytes()
+	aead, err := deriveECDHCipher(memguard.NewBufferFromBytes(sharedSecret), ephemeralPubKey, recipient.pubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	body := aead.Seal(ephemeralPubKey, make([]byte, aead.NonceSize()), contentKey.Bytes(), nil)
+	return &Stanza{kind: ecdhStanza, body: body}, nil
+}
+
+type ECDHIdentity struct {
+	privKey *ecdh.PrivateKey
+}
+
+func newECDHIdentity(privKey crypto.Signer) (*ECDHIdentity, error) {
+	switch privKey := privKey.(type) {
+	case ed25519.PrivateKey:
+		// X25519 keys are the first half of the hashed seed, which ed25519 clamps and uses as its scalar.
+		digest := sha512.Sum512(privKey.Seed())
+		x25519Key, err := ecdh.X25519().NewPrivateKey(digest[:32])
+		if err != nil {
+			return nil, err
+		}
+		return &ECDHIdentity{privKey: x25519Key}, nil
+	case *ecdsa.PrivateKey:
+		ecdhKey, err := privKey.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		return &ECDHIdentity{privKey: ecdhKey}, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key algorithm %T", privKey)
+	}
+}
+
+func (identity *ECDHIdentity) unwrap(stanza *Stanza) *memguard.LockedBuffer {
+	// Ephemeral keys are on the curve of the recipient's key, so they are as long as its public key.
+	pubKeyLength := len(identity.privKey.PublicKey().Bytes())
+	if stanza.kind != ecdhStanza || len(stanza.body) < pubKeyLength {
+		return nil
+	}
+
+	ephemeralPubKey, err := identity.privKey.Curve().NewPublicKey(stanza.body[:pubKeyLength])
+	if err != nil {
+		return nil
+	}
+
+	sharedSecret, err := identity.privKey.ECDH(ephemeralPubKey)
+	if err != nil {
+		return nil
+	}
+
+	secret := memguard.NewBufferFromBytes(sharedSecret)
+	aead, err := deriveECDHCipher(secret, stanza.body[:pubKeyLength], identity.privKey.PublicKey())
+	if err != nil {
+		return nil
+	}
+
+	contentKey, err := aead.Open(nil, make([]byte, aead.NonceSize()), stanza.body[pubKeyLength:], nil)
+	if err != nil {
+		return nil
+	}
+	return memguard.NewBufferFromBytes(contentKey)
+}
+
+// Every stanza has its own ephemeral key, so a fixed nonce is never reused with the same key.
+func deriveECDHCipher(
+	sharedSecret *memguard.LockedBuffer, ephemeralPubKey []byte, pubKey *ecdh.PublicKey,
+) (cipher.AEAD, error) {
+	defer sharedSecret.Destroy()
+
+	salt := append(append([]byte(nil), ephemeralPubKey...), pubKey.Bytes()...)
+	kdf := hkdf.New(sha256.New, sharedSecret.Bytes(), salt, []byte(ecdhWrapLabel))
+
+	key := memguard.NewBuffer(contentKeyLength)
+	defer key.Destroy()
+	key.Melt()
+
+	if _, err := io.ReadFull(kdf, key.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return cipherSuites[aes256GCMSuite].newAEAD(key.Bytes())
+}
+
+// Ed25519 public keys are the y coordinate of a point on the twisted Edwards curve, which is birationally equivalent
+// to Curve25519, where the u coordinate is (1 + y) / (1 - y).
+func ed25519PublicKeyToX25519(pubKey ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	if len(pubKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("malformed ed25519 public key")
+	}
+
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+	// Keys are little-endian, with the sign of x in the top bit.
+	encoded := make([]byte, ed25519.PublicKeySize)
+	for i, b := range pubKey {
+		encoded[len(encoded)-1-i] = b
+	}
+	encoded[0] &= 0x7f
+	y := new(big.Int).SetBytes(encoded)
+
+	denominator := new(big.Int).Sub(big.NewInt(1), y)
+	denominator.Mod(denominator, p)
+	if denominator.Sign() == 0 || y.Cmp(p) >= 0 {
+		return nil, fmt.Errorf("malformed ed25519 public key")
+	}
+
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, denominator.ModInverse(denominator, p))
+	u.Mod(u, p)
+
+	uBytes := u.FillBytes(make([]byte, 32))
+	for i, j := 0, len(uBytes)-1; i < j; i, j = i+1, j-1 {
+		uBytes[i], uBytes[j] = uBytes[j], uBytes[i]
+	}
+	return ecdh.X25519().NewPublicKey(uBytes)
+}
@@ -1,67 +1,322 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
-	"dead-drop/client/ghash"
+	"encoding/binary"
 	"fmt"
 	"github.com/awnumar/memguard"
+	"io"
+	"io/ioutil"
 )
 
 const ivLength = aes.BlockSize
 
-func encrypt(key *memguard.LockedBuffer, data []byte) ([]byte, error) {
-	encryptionKey, hmacKey := splitKeyHash(key)
+// Objects are encrypted as a header followed by a sequence of independently authenticated chunks.
+// Each chunk nonce encodes its position and whether it is the final chunk, so chunks cannot be
+// reordered, dropped, or truncated without failing authentication.
+//
+// The header identifies the format version, the cipher suite the chunks are sealed with, and the shared key the
+// object was encrypted with, followed by a random salt and the stanzas of any recipients:
+// magic | version | suite | key id | salt | recipient count | stanzas.
+// Enveloped objects are encrypted with a random content key, which is wrapped for each recipient by a stanza.
+// Objects without recipients are encrypted with a shared key directly, which the key id identifies.
+// The header is authenticated along with every chunk, so none of it can be changed or spliced.
+// The plaintext is a payload (see payload.go).
+const streamMagic = "dead"
+const formatVersion = 1
+const keyIDLength = 8
+const streamSaltLength = 32
+const streamChunkSize = 64 * 1024
+const objectKeyLabel = "dead-drop object v1"
+const headerLength = len(streamMagic) + 1 + 1 + keyIDLength + streamSaltLength + 1
+const contentKeyLength = 32
+const maxStanzaLength = 1<<16 - 1
 
-	block, err := aes.NewCipher(encryptionKey.Bytes())
+const finalChunkFlag = 1
+
+var errAuthentication = fmt.Errorf("object authentication failed")
+
+func encrypt(key *SharedKey, suite *CipherSuite, dst io.Writer, src io.Reader) error {
+	header, err := newHeader(suite, 0)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	copy(headerKeyID(header), key.id(headerSalt(header)))
 
-	ciphertext := memguard.NewBufferRandom(ivLength + len(data))
-	defer ciphertext.Destroy()
+	return sealObject(suite, key.sum, header, dst, src)
+}
 
-	iv := ciphertext.Bytes()[:ivLength]
-	stream := cipher.NewCTR(block, iv)
+func encryptEnvelope(recipients []Recipient, suite *CipherSuite, dst io.Writer, src io.Reader) error {
+	if len(recipients) == 0 || len(recipients) > 255 {
+		return fmt.Errorf("objects must have between 1 and 255 recipients")
+	}
 
-	ciphertext.Melt()
-	stream.XORKeyStream(ciphertext.Bytes()[ivLength:], data)
-	ciphertext.Freeze()
+	contentKey := memguard.NewBufferRandom(contentKeyLength)
+	defer contentKey.Destroy()
 
-	encryptionKey.Destroy()
+	header, err := newHeader(suite, byte(len(recipients)))
+	if err != nil {
+		return err
+	}
 
-	hash := hmac.New(sha256.New, hmacKey.Bytes())
-	hash.Write(ciphertext.Bytes())
-	signature := hash.Sum(nil)
-	hmacKey.Destroy()
+	for _, recipient := range recipients {
+		stanza, err := recipient.wrap(contentKey)
+		if err != nil {
+			return err
+		}
+		if len(stanza.body) > maxStanzaLength {
+			return fmt.Errorf("wrapped key is too long")
+		}
 
-	message := append(signature, ciphertext.Bytes()...)
-	return message, nil
+		header = append(header, stanza.kind, 0, 0)
+		binary.BigEndian.PutUint16(header[len(header)-2:], uint16(len(stanza.body)))
+		header = append(header, stanza.body...)
+	}
+
+	return sealObject(suite, contentKey, header, dst, src)
+}
+
+func newHeader(suite *CipherSuite, recipients byte) ([]byte, error) {
+	header := make([]byte, headerLength)
+	copy(header, streamMagic)
+	header[len(streamMagic)] = formatVersion
+	header[len(streamMagic)+1] = suite.id
+	if _, err := rand.Read(headerSalt(header)); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+	header[headerLength-1] = recipients
+	return header, nil
 }
 
-func decrypt(key *memguard.LockedBuffer, message []byte) (*memguard.LockedBuffer, error) {
+func headerKeyID(header []byte) []byte {
+	return header[len(streamMagic)+2 : len(streamMagic)+2+keyIDLength]
+}
+
+func headerSalt(header []byte) []byte {
+	return header[len(streamMagic)+2+keyIDLength : headerLength-1]
+}
+
+// The stream key is derived from everything in the header before the stanzas, so it is bound to the suite and key id.
+func sealObject(suite *CipherSuite, secret *memguard.LockedBuffer, header []byte, dst io.Writer, src io.Reader) error {
+	aead, err := deriveCipher(suite, objectKeyLabel, secret, header[:headerLength-1])
+	if err != nil {
+		return err
+	}
+
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+
+	return sealStream(aead, header, dst, src)
+}
+
+func sealStream(aead cipher.AEAD, header []byte, dst io.Writer, src io.Reader) error {
+	plaintext := memguard.NewBuffer(streamChunkSize)
+	defer plaintext.Destroy()
+	plaintext.Melt()
+
+	ciphertext := make([]byte, 0, streamChunkSize+aead.Overhead())
+	reader := bufio.NewReader(src)
+
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(reader, plaintext.Bytes())
+		final := false
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			final = true
+		} else if err != nil {
+			return err
+		} else if final, err = atEOF(reader); err != nil {
+			return err
+		}
+
+		ciphertext = aead.Seal(ciphertext[:0], chunkNonce(aead, counter, final), plaintext.Bytes()[:n], header)
+		if _, err := dst.Write(ciphertext); err != nil {
+			return err
+		}
+
+		if final {
+			return nil
+		}
+	}
+}
+
+// Decrypts an object with whichever of the keys in the keyring it was encrypted for.
+// Headerless objects are a single raw file, so they are given the payload header of one.
+func decrypt(keyring *Keyring, dst io.Writer, src io.Reader) error {
+	reader := bufio.NewReader(src)
+
+	prefix, err := reader.Peek(len(streamMagic) + 1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if !bytes.HasPrefix(prefix, []byte(streamMagic)) {
+		if keyring.sharedKey == nil {
+			return errNoSharedKey
+		}
+		if err := writePayloadHeader(dst, &PayloadHeader{Type: filePayload}); err != nil {
+			return err
+		}
+		return decryptLegacy(keyring.sharedKey, dst, reader)
+	}
+	if len(prefix) <= len(streamMagic) {
+		return errAuthentication
+	}
+
+	switch version := prefix[len(streamMagic)]; version {
+	case formatVersion:
+		return decryptObject(keyring, dst, reader)
+	default:
+		return fmt.Errorf("unsupported object format version %d", version)
+	}
+}
+
+func decryptObject(keyring *Keyring, dst io.Writer, reader *bufio.Reader) error {
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return errAuthentication
+	}
+
+	suite, ok := cipherSuites[header[len(streamMagic)+1]]
+	if !ok {
+		return fmt.Errorf("unsupported cipher suite %d", header[len(streamMagic)+1])
+	}
+
+	var secret *memguard.LockedBuffer
+	if header[headerLength-1] == 0 {
+		if keyring.sharedKey == nil {
+			return errNoSharedKey
+		}
+		if !hmac.Equal(headerKeyID(header), keyring.sharedKey.id(headerSalt(header))) {
+			return errWrongSharedKey
+		}
+		secret = keyring.sharedKey.sum
+	} else {
+		var contentKey *memguard.LockedBuffer
+		var err error
+		if header, contentKey, err = openEnvelope(keyring, header, reader); err != nil {
+			return err
+		}
+		defer contentKey.Destroy()
+		secret = contentKey
+	}
+
+	aead, err := deriveCipher(suite, objectKeyLabel, secret, header[:headerLength-1])
+	if err != nil {
+		return err
+	}
+
+	return openStream(aead, header, dst, reader)
+}
+
+// Reads the stanzas of an enveloped object, whose header so far ends with the recipient count, and unwraps its
+// content key with the first stanza the keyring can open.
+func openEnvelope(keyring *Keyring, header []byte, reader *bufio.Reader) ([]byte, *memguard.LockedBuffer, error) {
+	stanzas := make([]*Stanza, header[len(header)-1])
+	for i := range stanzas {
+		prefix := make([]byte, 3)
+		if _, err := io.ReadFull(reader, prefix); err != nil {
+			return nil, nil, errAuthentication
+		}
+
+		body := make([]byte, binary.BigEndian.Uint16(prefix[1:]))
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return nil, nil, errAuthentication
+		}
+
+		header = append(header, prefix...)
+		header = append(header, body...)
+		stanzas[i] = &Stanza{kind: prefix[0], body: body}
+	}
+
+	// Each identity tries every stanza before the next identity is tried, so interactive identities can go last.
+	for _, identity := range keyring.identities {
+		for _, stanza := range stanzas {
+			if contentKey := identity.unwrap(stanza); contentKey != nil {
+				if contentKey.Size() == contentKeyLength {
+					return header, contentKey, nil
+				}
+				contentKey.Destroy()
+			}
+		}
+	}
+
+	return nil, nil, errNoMatchingKey
+}
+
+func openStream(aead cipher.AEAD, header []byte, dst io.Writer, reader *bufio.Reader) error {
+	plaintext := memguard.NewBuffer(streamChunkSize)
+	defer plaintext.Destroy()
+	plaintext.Melt()
+
+	ciphertext := make([]byte, streamChunkSize+aead.Overhead())
+
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(reader, ciphertext)
+		final := false
+		if err == io.EOF {
+			// The previous chunk was not marked final, so the object has been truncated.
+			return errAuthentication
+		} else if err == io.ErrUnexpectedEOF {
+			final = true
+		} else if err != nil {
+			return err
+		} else if final, err = atEOF(reader); err != nil {
+			return err
+		}
+
+		chunk, err := aead.Open(plaintext.Bytes()[:0], chunkNonce(aead, counter, final), ciphertext[:n], header)
+		if err != nil {
+			return errAuthentication
+		}
+
+		if _, err := dst.Write(chunk); err != nil {
+			return err
+		}
+
+		if final {
+			return nil
+		}
+	}
+}
+
+// Objects dropped before the chunked format are a single AES-CTR ciphertext with a leading HMAC-SHA-256.
+func decryptLegacy(key *SharedKey, dst io.Writer, src io.Reader) error {
+	message, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	if len(message) < sha256.Size+ivLength {
+		return errAuthentication
+	}
+
 	encryptionKey, hmacKey := splitKeyHash(key)
+	defer encryptionKey.Destroy()
 
 	signature := message[:sha256.Size]
 	ciphertext := message[sha256.Size:]
 
 	hash := hmac.New(sha256.New, hmacKey.Bytes())
-	hash.Write([]byte(ciphertext))
+	hash.Write(ciphertext)
 	expectedSignature := hash.Sum(nil)
 	hmacKey.Destroy()
 
 	if !hmac.Equal(signature, expectedSignature) {
-		return nil, fmt.Errorf("bad signature")
+		return errAuthentication
 	}
 
 	block, err := aes.NewCipher(encryptionKey.Bytes())
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	data := memguard.NewBuffer(len(ciphertext) - ivLength)
+	defer data.Destroy()
 
 	iv := ciphertext[:ivLength]
 	stream := cipher.NewCTR(block, iv)
@@ -70,20 +325,45 @@ func decrypt(key *memguard.LockedBuffer, message []byte) (*memguard.LockedBuffer
 	stream.XORKeyStream(data.Bytes(), ciphertext[ivLength:])
 	data.Freeze()
 
-	encryptionKey.Destroy()
+	_, err = dst.Write(data.Bytes())
+	return err
+}
+
+func deriveCipher(suite *CipherSuite, label string, secret *memguard.LockedBuffer, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, secret.Bytes())
+	mac.Write([]byte(label))
+	mac.Write(salt)
+	key := memguard.NewBufferFromBytes(mac.Sum(nil))
+	defer key.Destroy()
+
+	return suite.newAEAD(key.Bytes())
+}
 
-	return data, nil
+// Stanzas and private keys are always sealed with AES-256-GCM, whichever suite the object uses.
+func deriveStreamCipher(label string, secret *memguard.LockedBuffer, salt []byte) (cipher.AEAD, error) {
+	return deriveCipher(cipherSuites[aes256GCMSuite], label, secret, salt)
 }
 
-func splitKeyHash(keyBuf *memguard.LockedBuffer) (*memguard.LockedBuffer, *memguard.LockedBuffer) {
-	sum := ghash.Sum256(keyBuf)
-	defer sum.Destroy()
+func chunkNonce(aead cipher.AEAD, counter uint64, final bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], counter)
+	if final {
+		nonce[len(nonce)-1] = finalChunkFlag
+	}
+	return nonce
+}
 
-	keyBuf.Destroy()
+func atEOF(reader *bufio.Reader) (bool, error) {
+	_, err := reader.Peek(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
+}
 
-	sum.Melt()
-	key1 := memguard.NewBufferFromBytes(sum.Bytes()[:16])
-	key2 := memguard.NewBufferFromBytes(sum.Bytes()[16:])
+func splitKeyHash(key *SharedKey) (*memguard.LockedBuffer, *memguard.LockedBuffer) {
+	key1 := memguard.NewBufferFromBytes(append([]byte(nil), key.sum.Bytes()[:16]...))
+	key2 := memguard.NewBufferFromBytes(append([]byte(nil), key.sum.Bytes()[16:]...))
 
 	return key1, key2
 }
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/pem"
+	"github.com/awnumar/memguard"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func testKey() *SharedKey {
+	return newSharedKey(memguard.NewBufferFromBytes([]byte("put your secret here")))
+}
+
+func randomBytes(t *testing.T, length int) []byte {
+	data := make([]byte, length)
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		t.Fatalf("Failed to generate data: %v", err)
+	}
+	return data
+}
+
+func encryptBytes(t *testing.T, suite *CipherSuite, data []byte) []byte {
+	ciphertext := new(bytes.Buffer)
+	if err := encrypt(testKey(), suite, ciphertext, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+	return ciphertext.Bytes()
+}
+
+func decryptBytes(ciphertext []byte) ([]byte, error) {
+	plaintext := new(bytes.Buffer)
+	err := decrypt(&Keyring{sharedKey: testKey()}, plaintext, bytes.NewReader(ciphertext))
+	return plaintext.Bytes(), err
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, streamChunkSize - 1, streamChunkSize, streamChunkSize + 1, 3*streamChunkSize + 17}
+
+	for _, suite := range cipherSuites {
+		for _, size := range sizes {
+			data := randomBytes(t, size)
+
+			plaintext, err := decryptBytes(encryptBytes(t, suite, data))
+			if err != nil {
+				t.Fatalf("Failed to decrypt %d bytes with %s: %v", size, suite.name, err)
+			}
+			if !bytes.Equal(plaintext, data) {
+				t.Fatalf("Decrypted %d bytes with %s do not match", size, suite.name)
+			}
+		}
+	}
+}
+
+func TestEncryptionRejectsTampering(t *testing.T) {
+	data := randomBytes(t, 2*streamChunkSize+100)
+	ciphertext := encryptBytes(t, cipherSuites[aes256GCMSuite], data)
+	chunkLength := streamChunkSize + 16
+
+	flipped := append([]byte(nil), ciphertext...)
+	flipped[headerLength+chunkLength+5] ^= 1
+
+	truncated := ciphertext[:headerLength+2*chunkLength]
+
+	reordered := append([]byte(nil), ciphertext[:headerLength]...)
+	reordered = append(reordered, ciphertext[headerLength+chunkLength:headerLength+2*chunkLength]...)
+	reordered = append(reordered, ciphertext[headerLength:headerLength+chunkLength]...)
+	reordered = append(reordered, ciphertext[headerLength+2*chunkLength:]...)
+
+	// Switching suites must not let an object be opened with a different cipher.
+	switched := append([]byte(nil), ciphertext...)
+	switched[len(streamMagic)+1] = xchacha20Poly1305Suite
+
+	cases := map[string][]byte{
+		"flipped":   flipped,
+		"truncated": truncated,
+		"reordered": reordered,
+		"switched":  switched,
+		"header":    ciphertext[:headerLength],
+	}
+	for name, message := range cases {
+		if _, err := decryptBytes(message); err != errAuthentication {
+			t.Fatalf("Expected %s object to fail authentication, got %v", name, err)
+		}
+	}
+
+	// Key ids are salted, so changing either makes the object look like it was encrypted with another key.
+	for _, offset := range []int{len(streamMagic) + 2, headerLength - 2} {
+		rekeyed := append([]byte(nil), ciphertext...)
+		rekeyed[offset] ^= 1
+		if _, err := decryptBytes(rekeyed); err != errWrongSharedKey {
+			t.Fatalf("Expected object with altered key id or salt to need another key, got %v", err)
+		}
+	}
+}
+
+func TestDecryptionOfOlderFormats(t *testing.T) {
+	data := randomBytes(t, streamChunkSize+100)
+	key := testKey()
+
+	// Headerless objects are hmac | iv | aes-ctr ciphertext.
+	encryptionKey, hmacKey := splitKeyHash(key)
+	block, err := aes.NewCipher(encryptionKey.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	iv := randomBytes(t, ivLength)
+	ctr := make([]byte, len(data))
+	cipher.NewCTR(block, iv).XORKeyStream(ctr, data)
+	mac := hmac.New(sha256.New, hmacKey.Bytes())
+	mac.Write(iv)
+	mac.Write(ctr)
+	legacy := append(append(mac.Sum(nil), iv...), ctr...)
+
+	plaintext := new(bytes.Buffer)
+	if err := decrypt(&Keyring{sharedKey: testKey()}, plaintext, bytes.NewReader(legacy)); err != nil {
+		t.Fatalf("Failed to decrypt legacy object: %v", err)
+	}
+
+	// Headerless objects are a single raw file, so they are given the payload header of one.
+	payload, err := readPayloadHeader(plaintext)
+	if err != nil || payload.Type != filePayload {
+		t.Fatalf("Expected legacy object to be a file payload, got %v (%v)", payload, err)
+	}
+	if !bytes.Equal(plaintext.Bytes(), data) {
+		t.Fatalf("Decrypted legacy object does not match")
+	}
+
+	unknownVersion := encryptBytes(t, cipherSuites[aes256GCMSuite], data)
+	unknownVersion[len(streamMagic)] = formatVersion + 1
+	unknownSuite := encryptBytes(t, cipherSuites[aes256GCMSuite], data)
+	unknownSuite[len(streamMagic)+1] = 0
+	for _, object := range [][]byte{unknownVersion, unknownSuite} {
+		if _, err := decryptBytes(object); err == nil || err == errAuthentication {
+			t.Fatalf("Expected unknown formats to be unsupported, got %v", err)
+		}
+	}
+}
+
+func TestEncryptionForRecipient(t *testing.T) {
+	recipientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate recipient key: %v", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate other key: %v", err)
+	}
+
+	data := randomBytes(t, streamChunkSize+100)
+	ciphertext := new(bytes.Buffer)
+	recipients := []Recipient{&RSARecipient{pubKey: &recipientKey.PublicKey}}
+	if err := encryptEnvelope(recipients, cipherSuites[aes256GCMSuite], ciphertext, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+
+	recipientKeyring := &Keyring{
+		identities: []Identity{&RSAIdentity{privKey: otherKey}, &RSAIdentity{privKey: recipientKey}},
+	}
+	plaintext := new(bytes.Buffer)
+	if err := decrypt(recipientKeyring, plaintext, bytes.NewReader(ciphertext.Bytes())); err != nil {
+		t.Fatalf("Failed to decrypt as recipient: %v", err)
+	}
+	if !bytes.Equal(plaintext.Bytes(), data) {
+		t.Fatalf("Decrypted object does not match")
+	}
+
+	otherKeyring := &Keyring{
+		sharedKey:  testKey(),
+		identities: []Identity{&RSAIdentity{privKey: otherKey}},
+	}
+	if err := decrypt(otherKeyring, new(bytes.Buffer), bytes.NewReader(ciphertext.Bytes())); err != errNoMatchingKey {
+		t.Fatalf("Expected other keys to not open the object, got %v", err)
+	}
+
+	// Swapping in a stanza wrapped with another content key must fail authentication.
+	forged := new(bytes.Buffer)
+	if err := encryptEnvelope(recipients, cipherSuites[aes256GCMSuite], forged, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+	spliced := append([]byte(nil), ciphertext.Bytes()...)
+	copy(spliced[headerLength:], forged.Bytes()[headerLength:headerLength+3+256])
+	if err := decrypt(recipientKeyring, new(bytes.Buffer), bytes.NewReader(spliced)); err != errAuthentication {
+		t.Fatalf("Expected spliced stanza to fail authentication, got %v", err)
+	}
+
+	if err := decrypt(recipientKeyring, new(bytes.Buffer), bytes.NewReader(encryptBytes(t, cipherSuites[aes256GCMSuite], data))); err != errNoSharedKey {
+		t.Fatalf("Expected shared key object to require the shared key, got %v", err)
+	}
+}
+
+func TestEncryptionForEachKeyType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dead-drop-recipients")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	generators := map[string]func() (crypto.Signer, error){
+		"rsa":     func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 2048) },
+		"ed25519": func() (crypto.Signer, error) { return generateKey(ed25519KeyType) },
+		"ecdsa":   func() (crypto.Signer, error) { return generateKey(ecdsaKeyType) },
+		"p384":    func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P384(), rand.Reader) },
+	}
+
+	data := randomBytes(t, 1000)
+	for name, generate := range generators {
+		privKey, err := generate()
+		if err != nil {
+			t.Fatalf("Failed to generate %s key: %v", name, err)
+		}
+		otherKey, err := generate()
+		if err != nil {
+			t.Fatalf("Failed to generate %s key: %v", name, err)
+		}
+
+		// Recipients are loaded from the public keys written by gen-key.
+		pubKeyDer, err := marshalPublicKey(privKey.Public())
+		if err != nil {
+			t.Fatalf("Failed to marshal %s public key: %v", name, err)
+		}
+		pubKeyPath := writeTestKey(t, dir, name+".pub", pem.EncodeToMemory(pubKeyDer))
+		recipient, err := loadRecipient(pubKeyPath)
+		if err != nil {
+			t.Fatalf("Failed to load %s recipient: %v", name, err)
+		}
+
+		ciphertext := new(bytes.Buffer)
+		suite := cipherSuites[aes256GCMSuite]
+		if err := encryptEnvelope([]Recipient{recipient}, suite, ciphertext, bytes.NewReader(data)); err != nil {
+			t.Fatalf("Failed to encrypt for %s key: %v", name, err)
+		}
+
+		identity, err := newIdentity(privKey)
+		if err != nil {
+			t.Fatalf("Failed to create %s identity: %v", name, err)
+		}
+		keyring := &Keyring{identities: []Identity{identity}}
+		plaintext := new(bytes.Buffer)
+		if err := decrypt(keyring, plaintext, bytes.NewReader(ciphertext.Bytes())); err != nil {
+			t.Fatalf("Failed to decrypt with %s key: %v", name, err)
+		}
+		if !bytes.Equal(plaintext.Bytes(), data) {
+			t.Fatalf("Object decrypted with %s key does not match", name)
+		}
+
+		otherIdentity, err := newIdentity(otherKey)
+		if err != nil {
+			t.Fatalf("Failed to create %s identity: %v", name, err)
+		}
+		otherKeyring := &Keyring{identities: []Identity{otherIdentity}}
+		if err := decrypt(otherKeyring, new(bytes.Buffer), bytes.NewReader(ciphertext.Bytes())); err != errNoMatchingKey {
+			t.Fatalf("Expected another %s key to not open the object, got %v", name, err)
+		}
+	}
+}
+
+func TestEncryptionForMultipleRecipients(t *testing.T) {
+	aliceKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	bobKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	teamKey := func() *SharedKey {
+		return newSharedKey(memguard.NewBufferFromBytes([]byte("incident response")))
+	}
+
+	data := randomBytes(t, 1000)
+	ciphertext := new(bytes.Buffer)
+	recipients := []Recipient{
+		&RSARecipient{pubKey: &aliceKey.PublicKey},
+		teamKey(),
+		&RSARecipient{pubKey: &bobKey.PublicKey},
+	}
+	if err := encryptEnvelope(recipients, cipherSuites[aes256GCMSuite], ciphertext, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+
+	keyrings := map[string]*Keyring{
+		"alice": {identities: []Identity{&RSAIdentity{privKey: aliceKey}}},
+		"bob":   {identities: []Identity{testKey(), &RSAIdentity{privKey: bobKey}}},
+		"team":  {identities: []Identity{teamKey()}},
+	}
+	for name, keyring := range keyrings {
+		plaintext := new(bytes.Buffer)
+		if err := decrypt(keyring, plaintext, bytes.NewReader(ciphertext.Bytes())); err != nil {
+			t.Fatalf("Failed to decrypt as %s: %v", name, err)
+		}
+		if !bytes.Equal(plaintext.Bytes(), data) {
+			t.Fatalf("Object decrypted by %s does not match", name)
+		}
+	}
+
+	outsider := &Keyring{sharedKey: testKey(), identities: []Identity{testKey()}}
+	if err := decrypt(outsider, new(bytes.Buffer), bytes.NewReader(ciphertext.Bytes())); err != errNoMatchingKey {
+		t.Fatalf("Expected an outsider to not open the object, got %v", err)
+	}
+}
+
+func TestEncryptionWithPassphrase(t *testing.T) {
+	passphrase := func() *memguard.LockedBuffer {
+		return memguard.NewBufferFromBytes([]byte("correct horse battery staple"))
+	}
+
+	data := randomBytes(t, 1000)
+	ciphertext := new(bytes.Buffer)
+	recipients := []Recipient{&PassphraseRecipient{passphrase: passphrase()}}
+	if err := encryptEnvelope(recipients, cipherSuites[aes256GCMSuite], ciphertext, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+
+	// The puller gets a few attempts to enter the right passphrase.
+	attempts := []string{"wrong horse battery staple", "correct horse battery staple"}
+	prompts := 0
+	keyring := &Keyring{identities: []Identity{&PassphraseIdentity{
+		prompt: func(string) (*memguard.LockedBuffer, error) {
+			prompts++
+			return memguard.NewBufferFromBytes([]byte(attempts[prompts-1])), nil
+		},
+	}}}
+
+	plaintext := new(bytes.Buffer)
+	if err := decrypt(keyring, plaintext, bytes.NewReader(ciphertext.Bytes())); err != nil {
+		t.Fatalf("Failed to decrypt with passphrase: %v", err)
+	}
+	if !bytes.Equal(plaintext.Bytes(), data) || prompts != 2 {
+		t.Fatalf("Expected object to decrypt after 2 prompts, got %d", prompts)
+	}
+
+	// Costs are read from the untrusted header, so excessive costs must be refused.
+	costly := append([]byte(nil), ciphertext.Bytes()...)
+	costly[headerLength+3+5] = 0xff
+	if err := decrypt(keyring, new(bytes.Buffer), bytes.NewReader(costly)); err != errNoMatchingKey {
+		t.Fatalf("Expected excessive kdf costs to be refused, got %v", err)
+	}
+}
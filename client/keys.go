@@ -0,0 +1,343 @@
+package main
+
+import (
+	"crypto"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"dead-drop/lib"
+	"encoding/pem"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const rsaKeyType = "rsa"
+const ed25519KeyType = "ed25519"
+const ecdsaKeyType = "ecdsa"
+
+const rsaKeyBits = 4096
+
+// Private keys are encrypted at rest with a key derived from a passphrase (see passphrase.go). The block holds the
+// passphrase params, followed by the sealed pem encoding of the unencrypted key.
+const encryptedPrivateKeyType = "DEAD-DROP ENCRYPTED PRIVATE KEY"
+const privateKeyWrapLabel = "dead-drop private key wrap"
+
+var errWrongPassphrase = fmt.Errorf("incorrect passphrase")
+
+// Any key type can both authenticate with the server and open objects dropped for its public key.
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case rsaKeyType:
+		return rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case ed25519KeyType:
+		_, privKey, err := ed25519.GenerateKey(rand.Reader)
+		return privKey, err
+	case ecdsaKeyType:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported key type '%s', must be one of rsa, ed25519, or ecdsa", keyType)
+	}
+}
+
+// RSA keys are encoded as PKCS#1 so they can be read by older clients and servers, and other keys as PKCS#8 and PKIX.
+func marshalPrivateKey(privKey crypto.Signer) (*pem.Block, error) {
+	if rsaKey, ok := privKey.(*rsa.PrivateKey); ok {
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}, nil
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+}
+
+func marshalPublicKey(pubKey crypto.PublicKey) (*pem.Block, error) {
+	if rsaKey, ok := pubKey.(*rsa.PublicKey); ok {
+		return &pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(rsaKey)}, nil
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: "PUBLIC KEY", Bytes: der}, nil
+}
+
+// Keys are only loaded once, so the passphrase of an encrypted key is prompted for at most once per command, even when
+// the key both signs requests and opens objects.
+var privateKeyCache = struct {
+	lock sync.Mutex
+	keys map[string]crypto.Signer
+}{keys: make(map[string]crypto.Signer)}
+
+func loadPrivateKey(rawPath string) (crypto.Signer, error) {
+	privKeyPath, err := homedir.Expand(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("error locating private key: %v", err)
+	}
+
+	privateKeyCache.lock.Lock()
+	defer privateKeyCache.lock.Unlock()
+
+	if privKey, ok := privateKeyCache.keys[privKeyPath]; ok {
+		return privKey, nil
+	}
+
+	privKeyDer, err := readPrivateKeyFile(privKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if privKeyDer.Type == encryptedPrivateKeyType {
+		if privKeyDer, err = unlockPrivateKey(privKeyDer, privKeyPath, readPassphrase); err != nil {
+			return nil, err
+		}
+	}
+
+	privKey, err := parsePrivateKey(privKeyDer)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		privKey, err = unlockOpenSSHPrivateKey(privKeyDer, privKeyPath, readPassphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %v", err)
+	}
+
+	privateKeyCache.keys[privKeyPath] = privKey
+	return privKey, nil
+}
+
+func readPrivateKeyFile(privKeyPath string) (*pem.Block, error) {
+	privKeyBytes, err := ioutil.ReadFile(privKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading private key '%s': %v", privKeyPath, err)
+	}
+
+	privKeyDer, _ := pem.Decode(privKeyBytes)
+	if privKeyDer == nil {
+		return nil, fmt.Errorf("failed to decode pem bytes of private key '%s'", privKeyPath)
+	}
+	return privKeyDer, nil
+}
+
+// The file is replaced atomically, so that the key is not lost if writing it fails part way.
+func writePrivateKeyFile(privKeyPath string, privKeyDer *pem.Block) error {
+	file, err := ioutil.TempFile(filepath.Dir(privKeyPath), filepath.Base(privKeyPath)+".tmp-")
+	if err != nil {
+		return err
+	}
+	tempPath := file.Name()
+
+	err = file.Chmod(lib.PrivateKeyPerms)
+	if err == nil {
+		err = pem.Encode(file, privKeyDer)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, privKeyPath)
+	}
+	if err != nil {
+		_ = os.Remove(tempPath)
+	}
+	return err
+}
+
+func unlockPrivateKey(
+	privKeyDer *pem.Block, privKeyPath string, prompt func(prompt string) (*memguard.LockedBuffer, error),
+) (*pem.Block, error) {
+	var decrypted *pem.Block
+	err := unlockWithPassphrase(privKeyPath, prompt, func(passphrase *memguard.LockedBuffer) (err error) {
+		decrypted, err = decryptPrivateKey(privKeyDer, passphrase)
+		return err
+	})
+	return decrypted, err
+}
+
+// OpenSSH keys with a passphrase (e.g. from ssh-keygen) are decrypted by x/crypto.
+func unlockOpenSSHPrivateKey(
+	privKeyDer *pem.Block, privKeyPath string, prompt func(prompt string) (*memguard.LockedBuffer, error),
+) (crypto.Signer, error) {
+	var privKey crypto.Signer
+	err := unlockWithPassphrase(privKeyPath, prompt, func(passphrase *memguard.LockedBuffer) error {
+		rawKey, err := ssh.ParseRawPrivateKeyWithPassphrase(pem.EncodeToMemory(privKeyDer), passphrase.Bytes())
+		if err == x509.IncorrectPasswordError {
+			return errWrongPassphrase
+		} else if err != nil {
+			return err
+		}
+
+		privKey, err = openSSHSigner(rawKey)
+		return err
+	})
+	return privKey, err
+}
+
+// Prompts for the passphrase of an encrypted key, with a few attempts to enter the right one.
+func unlockWithPassphrase(
+	privKeyPath string,
+	prompt func(prompt string) (*memguard.LockedBuffer, error),
+	unlock func(passphrase *memguard.LockedBuffer) error,
+) error {
+	for attempt := 1; ; attempt++ {
+		passphrase, err := prompt(fmt.Sprintf("Enter passphrase for %s: ", privKeyPath))
+		if err != nil {
+			return fmt.Errorf("error reading passphrase: %v", err)
+		}
+
+		err = unlock(passphrase)
+		passphrase.Destroy()
+		if err != errWrongPassphrase || attempt == maxPassphraseAttempts {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "Incorrect passphrase\n")
+	}
+}
+
+func encryptPrivateKey(privKeyDer *pem.Block, passphrase *memguard.LockedBuffer) (*pem.Block, error) {
+	params, err := newPassphraseParams()
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := derivePrivateKeyCipher(passphrase, params)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := aead.Seal(params, make([]byte, aead.NonceSize()), pem.EncodeToMemory(privKeyDer), nil)
+	return &pem.Block{Type: encryptedPrivateKeyType, Bytes: sealed}, nil
+}
+
+func decryptPrivateKey(privKeyDer *pem.Block, passphrase *memguard.LockedBuffer) (*pem.Block, error) {
+	if len(privKeyDer.Bytes) < passphraseParamsLength {
+		return nil, fmt.Errorf("malformed encrypted private key")
+	}
+	params := privKeyDer.Bytes[:passphraseParamsLength]
+
+	aead, err := derivePrivateKeyCipher(passphrase, params)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aead.Open(nil, make([]byte, aead.NonceSize()), privKeyDer.Bytes[passphraseParamsLength:], nil)
+	if err != nil {
+		return nil, errWrongPassphrase
+	}
+
+	decrypted, _ := pem.Decode(plaintext)
+	if decrypted == nil || decrypted.Type == encryptedPrivateKeyType {
+		return nil, fmt.Errorf("malformed encrypted private key")
+	}
+	return decrypted, nil
+}
+
+// Each key is derived with a fresh salt, so a fixed nonce is never reused with the same key.
+func derivePrivateKeyCipher(passphrase *memguard.LockedBuffer, params []byte) (cipher.AEAD, error) {
+	key, err := derivePassphraseKey(passphrase, params)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Destroy()
+
+	return deriveStreamCipher(privateKeyWrapLabel, key, params)
+}
+
+// Re-encrypts a key generated by gen-key with a new passphrase, or leaves it unencrypted if newPassphrase is nil.
+// Keys in other formats (e.g. OpenSSH keys) are left alone, since the tools which use them could not read them after.
+func changePassphrase(
+	privKeyPath string,
+	prompt func(prompt string) (*memguard.LockedBuffer, error),
+	newPassphrase func() (*memguard.LockedBuffer, error),
+) error {
+	privKeyDer, err := readPrivateKeyFile(privKeyPath)
+	if err != nil {
+		return err
+	}
+
+	switch privKeyDer.Type {
+	case encryptedPrivateKeyType:
+		if privKeyDer, err = unlockPrivateKey(privKeyDer, privKeyPath, prompt); err != nil {
+			return err
+		}
+	case "RSA PRIVATE KEY", "PRIVATE KEY":
+	default:
+		return fmt.Errorf(
+			"private keys of type '%s' were not generated by gen-key (use ssh-keygen -p for OpenSSH keys)", privKeyDer.Type,
+		)
+	}
+
+	// A key which cannot be parsed is not rewritten, so a corrupt key cannot replace the original.
+	if _, err := parsePrivateKey(privKeyDer); err != nil {
+		return fmt.Errorf("failed to parse private key: %v", err)
+	}
+
+	if newPassphrase != nil {
+		passphrase, err := newPassphrase()
+		if err != nil {
+			return fmt.Errorf("error reading passphrase: %v", err)
+		}
+		defer passphrase.Destroy()
+
+		if privKeyDer, err = encryptPrivateKey(privKeyDer, passphrase); err != nil {
+			return err
+		}
+	}
+
+	return writePrivateKeyFile(privKeyPath, privKeyDer)
+}
+
+func parsePrivateKey(privKeyDer *pem.Block) (crypto.Signer, error) {
+	switch privKeyDer.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(privKeyDer.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(privKeyDer.Bytes)
+	case "OPENSSH PRIVATE KEY":
+		return parseOpenSSHPrivateKey(privKeyDer)
+	case "PRIVATE KEY":
+		privKey, err := x509.ParsePKCS8PrivateKey(privKeyDer.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if signer, ok := privKey.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, fmt.Errorf("unsupported private key algorithm %T", privKey)
+	default:
+		return nil, fmt.Errorf("unsupported private key type '%s'", privKeyDer.Type)
+	}
+}
+
+// OpenSSH private keys (e.g. ~/.ssh/id_ed25519 or ~/.ssh/id_rsa) can be used directly. Keys with a passphrase fail
+// with *ssh.PassphraseMissingError, and must be unlocked with unlockOpenSSHPrivateKey instead.
+func parseOpenSSHPrivateKey(privKeyDer *pem.Block) (crypto.Signer, error) {
+	privKey, err := ssh.ParseRawPrivateKey(pem.EncodeToMemory(privKeyDer))
+	if err != nil {
+		return nil, err
+	}
+	return openSSHSigner(privKey)
+}
+
+func openSSHSigner(privKey interface{}) (crypto.Signer, error) {
+	switch privKey := privKey.(type) {
+	case *ed25519.PrivateKey:
+		return *privKey, nil
+	case crypto.Signer:
+		return privKey, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key algorithm %T", privKey)
+	}
+}
@@ -1,30 +1,60 @@
 package main
 
 import (
+	"encoding/base64"
 	"fmt"
+	"github.com/awnumar/memguard"
 	"strings"
 )
 
 const refSeparator = "#"
 
+// Capability references also carry the key of their object, prefixed by the version of the key encoding.
+const capabilityKeyPrefix = "k1."
+const capabilityKeyLength = 32
+
 type ObjectReference struct {
 	oid      string
 	checksum string
+	key      *memguard.LockedBuffer
 }
 
+// References are either oid#checksum, or capability references of the form oid#checksum#key.
 func parseObjectReference(input string) (*ObjectReference, error) {
-	split := strings.SplitN(input, refSeparator, 2)
-	if len(split) != 2 {
+	split := strings.Split(input, refSeparator)
+	if len(split) != 2 && len(split) != 3 {
 		return nil, fmt.Errorf("malformed object reference")
 	}
 
 	or := &ObjectReference{
-		oid: split[0],
+		oid:      split[0],
 		checksum: split[1],
 	}
+
+	if len(split) == 3 {
+		if !strings.HasPrefix(split[2], capabilityKeyPrefix) {
+			return nil, fmt.Errorf("unsupported object reference version")
+		}
+
+		key, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(split[2], capabilityKeyPrefix))
+		if err != nil || len(key) != capabilityKeyLength {
+			return nil, fmt.Errorf("malformed object reference key")
+		}
+		or.key = memguard.NewBufferFromBytes(key)
+	}
+
 	return or, nil
 }
 
 func (or *ObjectReference) String() string {
-	return fmt.Sprintf("%s%s%s", or.oid, refSeparator, or.checksum)
+	ref := fmt.Sprintf("%s%s%s", or.oid, refSeparator, or.checksum)
+	if or.key != nil {
+		ref += refSeparator + capabilityKeyPrefix + base64.RawURLEncoding.EncodeToString(or.key.Bytes())
+	}
+	return ref
+}
+
+// The key of a capability reference is used as a shared key, which is only ever known to holders of the reference.
+func (or *ObjectReference) sharedKey() *SharedKey {
+	return newSharedKey(memguard.NewBufferFromBytes(append([]byte(nil), or.key.Bytes()...)))
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"github.com/awnumar/memguard"
+	"testing"
+)
+
+func TestObjectReferences(t *testing.T) {
+	legacy := "nidavyihdlxwbbda#O3vVpwfUHqC2mWPPDIEVekzuKT2IeQ4BeHbkbCYg8lk="
+	or, err := parseObjectReference(legacy)
+	if err != nil {
+		t.Fatalf("Failed to parse legacy reference: %v", err)
+	}
+	if or.oid != "nidavyihdlxwbbda" || or.key != nil || or.String() != legacy {
+		t.Fatalf("Legacy reference did not round trip, got %s", or)
+	}
+
+	key := bytes.Repeat([]byte{0xfb}, capabilityKeyLength)
+	capability := &ObjectReference{
+		oid:      or.oid,
+		checksum: or.checksum,
+		key:      memguard.NewBufferFromBytes(append([]byte(nil), key...)),
+	}
+	parsed, err := parseObjectReference(capability.String())
+	if err != nil {
+		t.Fatalf("Failed to parse capability reference: %v", err)
+	}
+	if parsed.oid != or.oid || parsed.checksum != or.checksum || parsed.key == nil || !parsed.key.EqualTo(key) {
+		t.Fatalf("Capability reference did not round trip, got %s", parsed)
+	}
+
+	malformed := []string{
+		"nidavyihdlxwbbda",
+		legacy + "#" + capabilityKeyPrefix + "c2hvcnQ",
+		legacy + "#k9.AAAA",
+		legacy + "#" + capabilityKeyPrefix + "!!!",
+		capability.String() + "#extra",
+	}
+	for _, ref := range malformed {
+		if _, err := parseObjectReference(ref); err == nil {
+			t.Fatalf("Expected %s to be rejected", ref)
+		}
+	}
+}
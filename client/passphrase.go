@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/ssh/terminal"
+	"os"
+)
+
+const passphraseStanza = 3
+
+const argon2idKDF = 1
+
+// Costs are stored in each stanza, so they can be raised without breaking existing objects.
+const argon2Time = 3
+const argon2Memory = 64 * 1024
+const argon2Threads = 4
+const argon2SaltLength = 16
+
+// Objects are untrusted, so they cannot make a puller spend more than this deriving a key.
+const maxArgon2Time = 16
+const maxArgon2Memory = 1024 * 1024
+
+const passphraseParamsLength = 1 + 4 + 4 + 1 + argon2SaltLength
+const passphraseWrapLabel = "dead-drop passphrase wrap"
+const maxPassphraseAttempts = 3
+
+// The content key is sealed under a key derived from a passphrase with Argon2id.
+// The stanza holds the kdf, its costs, and a random salt, followed by the sealed content key.
+type PassphraseRecipient struct {
+	passphrase *memguard.LockedBuffer
+}
+
+func (recipient *PassphraseRecipient) wrap(contentKey *memguard.LockedBuffer) (*Stanza, error) {
+	params, err := newPassphraseParams()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := derivePassphraseKey(recipient.passphrase, params)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Destroy()
+
+	aead, err := deriveStreamCipher(passphraseWrapLabel, key, params)
+	if err != nil {
+		return nil, err
+	}
+
+	body := aead.Seal(params, make([]byte, aead.NonceSize()), contentKey.Bytes(), nil)
+	return &Stanza{kind: passphraseStanza, body: body}, nil
+}
+
+func (recipient *PassphraseRecipient) destroy() {
+	recipient.passphrase.Destroy()
+}
+
+// The passphrase is only prompted for once an object turns out to need it.
+type PassphraseIdentity struct {
+	prompt func(prompt string) (*memguard.LockedBuffer, error)
+}
+
+func (identity *PassphraseIdentity) unwrap(stanza *Stanza) *memguard.LockedBuffer {
+	if stanza.kind != passphraseStanza || len(stanza.body) < passphraseParamsLength {
+		return nil
+	}
+	params := stanza.body[:passphraseParamsLength]
+	if err := checkPassphraseParams(params); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return nil
+	}
+
+	for attempt := 1; attempt <= maxPassphraseAttempts; attempt++ {
+		passphrase, err := identity.prompt("Enter passphrase: ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Failed to read passphrase: %v\n", err)
+			return nil
+		}
+
+		key, err := derivePassphraseKey(passphrase, params)
+		passphrase.Destroy()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			return nil
+		}
+
+		aead, err := deriveStreamCipher(passphraseWrapLabel, key, params)
+		key.Destroy()
+		if err != nil {
+			return nil
+		}
+
+		contentKey, err := aead.Open(nil, make([]byte, aead.NonceSize()), stanza.body[passphraseParamsLength:], nil)
+		if err == nil {
+			return memguard.NewBufferFromBytes(contentKey)
+		}
+
+		fmt.Fprintf(os.Stderr, "Incorrect passphrase\n")
+	}
+
+	return nil
+}
+
+// The kdf, its costs, and a random salt.
+func newPassphraseParams() ([]byte, error) {
+	params := make([]byte, passphraseParamsLength)
+	params[0] = argon2idKDF
+	binary.BigEndian.PutUint32(params[1:], argon2Time)
+	binary.BigEndian.PutUint32(params[5:], argon2Memory)
+	params[9] = argon2Threads
+	if _, err := rand.Read(params[10:]); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+	return params, nil
+}
+
+func checkPassphraseParams(params []byte) error {
+	if params[0] != argon2idKDF {
+		return fmt.Errorf("unsupported passphrase kdf %d", params[0])
+	}
+
+	time := binary.BigEndian.Uint32(params[1:])
+	memory := binary.BigEndian.Uint32(params[5:])
+	threads := params[9]
+	if time == 0 || time > maxArgon2Time || memory == 0 || memory > maxArgon2Memory || threads == 0 {
+		return fmt.Errorf("passphrase kdf costs are out of bounds")
+	}
+	return nil
+}
+
+func derivePassphraseKey(passphrase *memguard.LockedBuffer, params []byte) (*memguard.LockedBuffer, error) {
+	if err := checkPassphraseParams(params); err != nil {
+		return nil, err
+	}
+
+	time := binary.BigEndian.Uint32(params[1:])
+	memory := binary.BigEndian.Uint32(params[5:])
+	key := argon2.IDKey(passphrase.Bytes(), params[10:passphraseParamsLength], time, memory, params[9], 32)
+	return memguard.NewBufferFromBytes(key), nil
+}
+
+// Passphrases are read from the terminal directly, so they never pass through stdin or shell history.
+func readPassphrase(prompt string) (*memguard.LockedBuffer, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("no terminal to prompt on: %v", err)
+	}
+	defer tty.Close()
+
+	if _, err = fmt.Fprint(tty, prompt); err != nil {
+		return nil, err
+	}
+	passphrase, err := terminal.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("passphrase must not be empty")
+	}
+	return memguard.NewBufferFromBytes(passphrase), nil
+}
+
+func readNewPassphrase(prompt string) (*memguard.LockedBuffer, error) {
+	passphrase, err := readPassphrase(prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	confirmation, err := readPassphrase("Confirm passphrase: ")
+	if err != nil {
+		passphrase.Destroy()
+		return nil, err
+	}
+	defer confirmation.Destroy()
+
+	if !confirmation.EqualTo(passphrase.Bytes()) {
+		passphrase.Destroy()
+		return nil, fmt.Errorf("passphrases do not match")
+	}
+	return passphrase, nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"archive/tar"
+	"dead-drop/lib"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The plaintext of an object starts with a payload header, which describes whether the rest of the plaintext is a
+// single file, or a tar archive of several files and directories. The header is encoded as json, and prefixed by its
+// length as a big-endian uint32. Since the header is encrypted, it can carry the metadata of a file (and a note from
+// the dropper) without revealing it to the server.
+const filePayload = "file"
+const archivePayload = "archive"
+const maxPayloadHeaderLength = 64 * 1024
+const maxNoteLength = 4096
+
+// Metadata is only known for files dropped from a path, so every field but the type is optional.
+type PayloadHeader struct {
+	Type    string      `json:"type"`
+	Name    string      `json:"name,omitempty"`
+	Size    *int64      `json:"size,omitempty"`
+	Mode    os.FileMode `json:"mode,omitempty"`
+	ModTime *time.Time  `json:"mtime,omitempty"`
+	Note    string      `json:"note,omitempty"`
+
+	// How the rest of the payload is compressed (see compression.go), if at all.
+	Compression string `json:"compression,omitempty"`
+}
+
+// Files with names like these usually hold secrets, so they are never restored with more than owner permissions.
+var privateNamePatterns = []string{
+	"id_*", "*.pem", "*.key", "*.p12", "*.pfx", "*.jks", "*.keystore", "*.kdbx", "*.ppk", "*.gpg", "*.asc",
+	".env", ".env.*", "*.env", ".netrc", ".pgpass", "*secret*", "*credential*", "*password*", "*private*", "*token*",
+}
+
+func writePayloadHeader(dst io.Writer, header *PayloadHeader) error {
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	prefix := make([]byte, 4)
+	binary.BigEndian.PutUint32(prefix, uint32(len(encoded)))
+	if _, err := dst.Write(prefix); err != nil {
+		return err
+	}
+	_, err = dst.Write(encoded)
+	return err
+}
+
+func readPayloadHeader(src io.Reader) (*PayloadHeader, error) {
+	prefix := make([]byte, 4)
+	if _, err := io.ReadFull(src, prefix); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(prefix)
+	if length > maxPayloadHeaderLength {
+		return nil, fmt.Errorf("payload header is too long")
+	}
+
+	encoded := make([]byte, length)
+	if _, err := io.ReadFull(src, encoded); err != nil {
+		return nil, err
+	}
+
+	header := &PayloadHeader{}
+	if err := json.Unmarshal(encoded, header); err != nil {
+		return nil, fmt.Errorf("malformed payload header: %v", err)
+	}
+	return header, nil
+}
+
+// Paths are checked before anything is uploaded, so that a bad path does not leave behind an unfinished upload.
+func checkPayloadPaths(paths []string) error {
+	if len(paths) == 1 && paths[0] == stdioPath {
+		return nil
+	}
+
+	names := make(map[string]string)
+	for _, rawPath := range paths {
+		if rawPath == stdioPath {
+			return fmt.Errorf("stdin cannot be dropped along with other files")
+		}
+
+		info, err := os.Lstat(rawPath)
+		if err != nil {
+			return fmt.Errorf("error reading file '%s': %v", rawPath, err)
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return fmt.Errorf("'%s' is not a regular file or directory", rawPath)
+		}
+
+		name, err := archiveName(rawPath)
+		if err != nil {
+			return err
+		}
+		if other, ok := names[name]; ok {
+			return fmt.Errorf("'%s' and '%s' would have the same name in the archive", other, rawPath)
+		}
+		names[name] = rawPath
+	}
+
+	return nil
+}
+
+// Writes the payload of the dropped paths, with the note and compression of the given header.
+// A single file is written as is, and anything else is packed into an archive.
+func writePayload(paths []string, header *PayloadHeader, dst io.Writer) error {
+	pack := packArchive
+	header.Type = archivePayload
+
+	if len(paths) == 1 && paths[0] == stdioPath {
+		header.Type = filePayload
+		pack = func(paths []string, dst io.Writer) error {
+			_, err := io.Copy(dst, os.Stdin)
+			return err
+		}
+	} else if len(paths) == 1 {
+		if info, err := os.Stat(paths[0]); err == nil && info.Mode().IsRegular() {
+			size := info.Size()
+			modTime := info.ModTime()
+			header.Type = filePayload
+			header.Name = info.Name()
+			header.Size = &size
+			header.Mode = info.Mode().Perm()
+			header.ModTime = &modTime
+			pack = func(paths []string, dst io.Writer) error {
+				return copyFile(dst, paths[0])
+			}
+		}
+	}
+
+	if err := writePayloadHeader(dst, header); err != nil {
+		return err
+	}
+
+	body, err := compressPayload(header.Compression, dst)
+	if err != nil {
+		return err
+	}
+	if err := pack(paths, body); err != nil {
+		return err
+	}
+	return body.Close()
+}
+
+func copyFile(dst io.Writer, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("error reading file '%s': %v", filePath, err)
+	}
+	defer file.Close()
+
+	_, err = io.Copy(dst, file)
+	return err
+}
+
+// Each path is packed under its own name, so `dead drop dir/` unpacks to dir, and `dead drop a b` unpacks to a and b.
+// Only permission bits are kept, and anything other than regular files and directories (e.g. symlinks) is skipped.
+func packArchive(paths []string, dst io.Writer) error {
+	archive := tar.NewWriter(dst)
+
+	for _, rawPath := range paths {
+		absPath, err := filepath.Abs(rawPath)
+		if err != nil {
+			return err
+		}
+		root := filepath.Dir(absPath)
+
+		err = filepath.Walk(absPath, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			name, err := filepath.Rel(root, filePath)
+			if err != nil {
+				return err
+			}
+
+			header := &tar.Header{
+				Name:    filepath.ToSlash(name),
+				Mode:    int64(info.Mode().Perm()),
+				ModTime: info.ModTime(),
+			}
+			switch {
+			case info.IsDir():
+				header.Typeflag = tar.TypeDir
+				header.Name += "/"
+			case info.Mode().IsRegular():
+				header.Typeflag = tar.TypeReg
+				header.Size = info.Size()
+			default:
+				fmt.Fprintf(os.Stderr, "WARN: Skipping '%s', which is not a regular file or directory\n", filePath)
+				return nil
+			}
+
+			if err := archive.WriteHeader(header); err != nil {
+				return err
+			}
+			if header.Typeflag == tar.TypeReg {
+				return copyFile(archive, filePath)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+func archiveName(rawPath string) (string, error) {
+	absPath, err := filepath.Abs(rawPath)
+	if err != nil {
+		return "", err
+	}
+
+	name := filepath.Base(absPath)
+	if name == string(filepath.Separator) {
+		return "", fmt.Errorf("the root directory cannot be dropped")
+	}
+	return name, nil
+}
+
+// Names are only restored if they are a single plain path component, so a malicious name cannot write elsewhere.
+func restoredName(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || len(name) > 255 || strings.ContainsAny(name, "/\\") {
+		return "", fmt.Errorf("object has no name that can be restored, a destination path is required")
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("object has no name that can be restored, a destination path is required")
+		}
+	}
+	return name, nil
+}
+
+// Files are restored with their original permissions (or the default object permissions if unknown), except that
+// private-looking files never get more than owner permissions.
+func restoredMode(name string, mode os.FileMode) os.FileMode {
+	if mode == 0 {
+		mode = lib.ObjectPerms
+	}
+	if isPrivateName(name) {
+		mode &= 0700
+		if mode == 0 {
+			mode = lib.PrivateKeyPerms
+		}
+	}
+	return mode.Perm()
+}
+
+func isPrivateName(name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range privateNamePatterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Notes are written to the terminal, so control characters (e.g. escape sequences) are stripped from them.
+func sanitizeNote(note string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return -1
+		}
+		return r
+	}, note)
+}
+
+type unpackedDir struct {
+	path    string
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// Unpacks an archive into an empty directory. Entries must be regular files or directories within the directory,
+// so a malicious archive cannot write anywhere else (e.g. with ../ or absolute paths, or through symlinks).
+func unpackArchive(src io.Reader, dir string) error {
+	archive := tar.NewReader(src)
+	dirs := make([]*unpackedDir, 0)
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		entryPath, err := archiveEntryPath(dir, header.Name)
+		if err != nil {
+			return err
+		}
+		mode := os.FileMode(header.Mode).Perm()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(entryPath, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, &unpackedDir{path: entryPath, mode: mode | 0700, modTime: header.ModTime})
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(entryPath), 0700); err != nil {
+				return err
+			}
+			if err := unpackFile(archive, entryPath, restoredMode(path.Base(header.Name), mode)); err != nil {
+				return err
+			}
+			if err := os.Chtimes(entryPath, header.ModTime, header.ModTime); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("archive entry '%s' is not a regular file or directory", header.Name)
+		}
+	}
+
+	// Directories are only given their permissions and times once unpacked, since unpacking their entries changes both.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return err
+		}
+		if err := os.Chtimes(dirs[i].path, dirs[i].modTime, dirs[i].modTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func archiveEntryPath(dir string, name string) (string, error) {
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("archive entry '%s' is outside of the destination", name)
+	}
+	return filepath.Join(dir, filepath.FromSlash(clean)), nil
+}
+
+func unpackFile(src io.Reader, filePath string, mode os.FileMode) error {
+	// Entries are never overwritten, so an archive cannot replace a file it has already unpacked.
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, src); err != nil {
+		return err
+	}
+	if err := file.Chmod(mode); err != nil {
+		return err
+	}
+	return file.Close()
+}
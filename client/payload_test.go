@@ -0,0 +1,167 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"dead-drop/lib"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchivePayload(t *testing.T) {
+	src, err := ioutil.TempDir("", "dead-drop-src")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(src)
+
+	files := map[string]os.FileMode{
+		"certs/server.crt":     0644,
+		"certs/private/server": 0600,
+		"ca.crt":               0640,
+	}
+	for name, mode := range files {
+		filePath := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(filePath), 0750); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := ioutil.WriteFile(filePath, []byte(name), mode); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	paths := []string{filepath.Join(src, "certs"), filepath.Join(src, "ca.crt")}
+	if err := checkPayloadPaths(paths); err != nil {
+		t.Fatalf("Failed to check paths: %v", err)
+	}
+
+	payload := new(bytes.Buffer)
+	if err := writePayload(paths, &PayloadHeader{Compression: gzipCompression}, payload); err != nil {
+		t.Fatalf("Failed to write payload: %v", err)
+	}
+	header, err := readPayloadHeader(payload)
+	if err != nil || header.Type != archivePayload || header.Compression != gzipCompression {
+		t.Fatalf("Expected a compressed archive payload, got %v (%v)", header, err)
+	}
+	body, err := decompressPayload(header.Compression, payload)
+	if err != nil {
+		t.Fatalf("Failed to decompress payload: %v", err)
+	}
+
+	dest, err := ioutil.TempDir("", "dead-drop-dest")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dest)
+
+	if err := unpackArchive(body, dest); err != nil {
+		t.Fatalf("Failed to unpack archive: %v", err)
+	}
+	for name, mode := range files {
+		filePath := filepath.Join(dest, name)
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil || string(data) != name {
+			t.Fatalf("Unpacked %s does not match (%v)", name, err)
+		}
+		if info, err := os.Stat(filePath); err != nil || info.Mode().Perm() != mode {
+			t.Fatalf("Expected %s to have mode %v, got %v (%v)", name, mode, info.Mode().Perm(), err)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dest, "certs")); err != nil || info.Mode().Perm() != 0750 {
+		t.Fatalf("Expected unpacked directory to keep its mode (%v)", err)
+	}
+
+	duplicate := []string{filepath.Join(src, "ca.crt"), filepath.Join(src, "certs", "..", "ca.crt")}
+	if err := checkPayloadPaths(duplicate); err == nil {
+		t.Fatalf("Expected paths with the same name to be rejected")
+	}
+}
+
+func TestFilePayload(t *testing.T) {
+	file, err := ioutil.TempFile("", "server.key")
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("secret")
+	file.Close()
+
+	modTime := time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(file.Name(), modTime, modTime); err != nil {
+		t.Fatalf("Failed to set file times: %v", err)
+	}
+
+	payload := new(bytes.Buffer)
+	if err := writePayload([]string{file.Name()}, &PayloadHeader{Note: "rotate after use"}, payload); err != nil {
+		t.Fatalf("Failed to write payload: %v", err)
+	}
+	header, err := readPayloadHeader(payload)
+	if err != nil {
+		t.Fatalf("Failed to read payload header: %v", err)
+	}
+	if header.Type != filePayload || header.Name != filepath.Base(file.Name()) || *header.Size != 6 ||
+		header.Mode != 0600 || !header.ModTime.Equal(modTime) || header.Note != "rotate after use" {
+		t.Fatalf("Payload header does not match the file, got %+v", header)
+	}
+	if payload.String() != "secret" {
+		t.Fatalf("Payload does not match the file, got %s", payload.String())
+	}
+
+	for _, name := range []string{"", ".", "..", "../passwd", "dir/file", "evil\x1b[2J"} {
+		if _, err := restoredName(name); err == nil {
+			t.Fatalf("Expected name %q to not be restored", name)
+		}
+	}
+
+	modes := map[string]os.FileMode{
+		"notes.txt":   0664,
+		"server.KEY":  0600,
+		"id_ed25519":  0600,
+		".env":        0600,
+		"db-password": 0600,
+	}
+	for name, mode := range modes {
+		if restored := restoredMode(name, 0664); restored != mode {
+			t.Fatalf("Expected %s to be restored with mode %v, got %v", name, mode, restored)
+		}
+	}
+	if restored := restoredMode("notes.txt", 0); restored != lib.ObjectPerms {
+		t.Fatalf("Expected files without a mode to get the default mode, got %v", restored)
+	}
+}
+
+func TestUnpackRejectsUnsafeEntries(t *testing.T) {
+	entries := map[string]*tar.Header{
+		"parent":   {Name: "../escape", Typeflag: tar.TypeReg},
+		"nested":   {Name: "dir/../../escape", Typeflag: tar.TypeReg},
+		"absolute": {Name: "/tmp/escape", Typeflag: tar.TypeReg},
+		"symlink":  {Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+		"hardlink": {Name: "link", Typeflag: tar.TypeLink, Linkname: "../escape"},
+	}
+
+	for name, entry := range entries {
+		archive := new(bytes.Buffer)
+		writer := tar.NewWriter(archive)
+		if err := writer.WriteHeader(entry); err != nil {
+			t.Fatalf("Failed to write %s entry: %v", name, err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to write %s archive: %v", name, err)
+		}
+
+		dest, err := ioutil.TempDir("", "dead-drop-dest")
+		if err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+
+		err = unpackArchive(archive, filepath.Join(dest, "inner"))
+		entries, _ := ioutil.ReadDir(dest)
+		os.RemoveAll(dest)
+		if err == nil || len(entries) != 0 {
+			t.Fatalf("Expected %s entry to be rejected, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"dead-drop/client/ghash"
+	"encoding/pem"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"github.com/mitchellh/go-homedir"
+	"io/ioutil"
+)
+
+const rsaStanza = 1
+const sharedKeyStanza = 2
+
+const contentKeyLabel = "dead-drop content key"
+const sharedKeyWrapLabel = "dead-drop shared key wrap"
+const keyIDLabel = "dead-drop key id"
+
+var errNoSharedKey = fmt.Errorf("object was encrypted with a shared encryption key, but none is configured")
+var errWrongSharedKey = fmt.Errorf("object was encrypted with a different shared encryption key than the one configured")
+var errNoMatchingKey = fmt.Errorf("object was not encrypted for any of the configured keys")
+
+// A Stanza holds the content key of an enveloped object, wrapped for a single recipient.
+type Stanza struct {
+	kind byte
+	body []byte
+}
+
+type Recipient interface {
+	wrap(contentKey *memguard.LockedBuffer) (*Stanza, error)
+}
+
+type Identity interface {
+	// Returns nil if the stanza was not wrapped for this identity.
+	unwrap(stanza *Stanza) *memguard.LockedBuffer
+}
+
+// A Keyring holds the keys a puller has, any of which may be able to open an object.
+type Keyring struct {
+	sharedKey  *SharedKey
+	identities []Identity
+}
+
+// A SharedKey is a key file shared by the dropper and the puller. Key files may hold anything (e.g. a sentence),
+// so they are hashed before any keys are derived from them.
+type SharedKey struct {
+	sum *memguard.LockedBuffer
+}
+
+func newSharedKey(keyBuf *memguard.LockedBuffer) *SharedKey {
+	sum := ghash.Sum256(keyBuf)
+	keyBuf.Destroy()
+
+	return &SharedKey{sum: sum}
+}
+
+// The content key is sealed under a key derived from the shared key and a random salt, which leads the stanza.
+// Every stanza has its own salt, so a fixed nonce is never reused with the same key.
+func (key *SharedKey) wrap(contentKey *memguard.LockedBuffer) (*Stanza, error) {
+	salt := make([]byte, streamSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+
+	aead, err := deriveStreamCipher(sharedKeyWrapLabel, key.sum, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	body := aead.Seal(salt, make([]byte, aead.NonceSize()), contentKey.Bytes(), nil)
+	return &Stanza{kind: sharedKeyStanza, body: body}, nil
+}
+
+func (key *SharedKey) unwrap(stanza *Stanza) *memguard.LockedBuffer {
+	if stanza.kind != sharedKeyStanza || len(stanza.body) < streamSaltLength {
+		return nil
+	}
+
+	aead, err := deriveStreamCipher(sharedKeyWrapLabel, key.sum, stanza.body[:streamSaltLength])
+	if err != nil {
+		return nil
+	}
+
+	contentKey, err := aead.Open(nil, make([]byte, aead.NonceSize()), stanza.body[streamSaltLength:], nil)
+	if err != nil {
+		return nil
+	}
+	return memguard.NewBufferFromBytes(contentKey)
+}
+
+// Key ids are salted by each object, so only holders of the key can tell which objects were encrypted with it.
+func (key *SharedKey) id(salt []byte) []byte {
+	mac := hmac.New(sha256.New, key.sum.Bytes())
+	mac.Write([]byte(keyIDLabel))
+	mac.Write(salt)
+	return mac.Sum(nil)[:keyIDLength]
+}
+
+func (key *SharedKey) destroy() {
+	key.sum.Destroy()
+}
+
+// Recipients holding secrets (e.g. shared keys and passphrases) destroy them once the object is encrypted.
+func destroyRecipients(recipients []Recipient) {
+	for _, recipient := range recipients {
+		if secret, ok := recipient.(interface{ destroy() }); ok {
+			secret.destroy()
+		}
+	}
+}
+
+func (keyring *Keyring) destroy() {
+	if keyring.sharedKey != nil {
+		keyring.sharedKey.destroy()
+	}
+}
+
+// RSA keys cannot agree on a key, so the content key is encrypted to the recipient directly with RSA-OAEP.
+type RSARecipient struct {
+	pubKey *rsa.PublicKey
+}
+
+func (recipient *RSARecipient) wrap(contentKey *memguard.LockedBuffer) (*Stanza, error) {
+	body, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, recipient.pubKey, contentKey.Bytes(), []byte(contentKeyLabel))
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap content key: %v", err)
+	}
+	return &Stanza{kind: rsaStanza, body: body}, nil
+}
+
+type RSAIdentity struct {
+	privKey *rsa.PrivateKey
+}
+
+func (identity *RSAIdentity) unwrap(stanza *Stanza) *memguard.LockedBuffer {
+	if stanza.kind != rsaStanza {
+		return nil
+	}
+
+	contentKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, identity.privKey, stanza.body, []byte(contentKeyLabel))
+	if err != nil {
+		return nil
+	}
+	return memguard.NewBufferFromBytes(contentKey)
+}
+
+// RSA keys are wrapped for with RSA-OAEP, and Ed25519 and ECDSA keys with an ephemeral key agreement.
+func loadRecipient(rawPath string) (Recipient, error) {
+	pubKeyPath, err := homedir.Expand(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("error locating public key: %v", err)
+	}
+
+	pubKeyBytes, err := ioutil.ReadFile(pubKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading public key '%s': %v", pubKeyPath, err)
+	}
+
+	pubKeyDer, _ := pem.Decode(pubKeyBytes)
+	if pubKeyDer == nil {
+		return nil, fmt.Errorf("failed to decode pem bytes of public key '%s'", pubKeyPath)
+	}
+
+	switch pubKeyDer.Type {
+	case "RSA PUBLIC KEY":
+		pubKey, err := x509.ParsePKCS1PublicKey(pubKeyDer.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return &RSARecipient{pubKey: pubKey}, nil
+	case "PUBLIC KEY":
+		pubKey, err := x509.ParsePKIXPublicKey(pubKeyDer.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if rsaPubKey, ok := pubKey.(*rsa.PublicKey); ok {
+			return &RSARecipient{pubKey: rsaPubKey}, nil
+		}
+		recipient, err := newECDHRecipient(pubKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading public key '%s': %v", pubKeyPath, err)
+		}
+		return recipient, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type '%s' in '%s'", pubKeyDer.Type, pubKeyPath)
+}
+
+// Private keys can open objects dropped for their public key, except for key types that cannot agree on a key.
+func newIdentity(privKey crypto.Signer) (Identity, error) {
+	if rsaKey, ok := privKey.(*rsa.PrivateKey); ok {
+		return &RSAIdentity{privKey: rsaKey}, nil
+	}
+	return newECDHIdentity(privKey)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"strings"
+)
+
+const aes256GCMSuite = 1
+const xchacha20Poly1305Suite = 2
+
+// A CipherSuite is the aead that the chunks of an object are sealed with, identified in the header by its id.
+// Suites are only ever added, so that objects sealed with older suites can still be pulled.
+type CipherSuite struct {
+	id      byte
+	name    string
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+var cipherSuites = map[byte]*CipherSuite{
+	aes256GCMSuite:         {id: aes256GCMSuite, name: "AES-256-GCM", newAEAD: newAESGCM},
+	xchacha20Poly1305Suite: {id: xchacha20Poly1305Suite, name: "XChaCha20-Poly1305", newAEAD: chacha20poly1305.NewX},
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func parseCipherSuite(name string) (*CipherSuite, error) {
+	for _, suite := range cipherSuites {
+		if strings.EqualFold(suite.name, name) {
+			return suite, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported cipher suite '%s'", name)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"dead-drop/lib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Objects are uploaded in chunks, so an interrupted upload only has to resend the chunk in flight.
+const uploadChunkSize = 8 << 20
+const maxUploadAttempts = 6
+
+var uploadRetryDelay = time.Second
+
+type Upload struct {
+	client *http.Client
+	remote string
+	sid    string
+}
+
+// Uploads the data through an upload session, resuming after network errors, and returns the response of the
+// finalized session.
+func upload(client *http.Client, remote string, data io.Reader, header http.Header) (*http.Response, error) {
+	u := &Upload{
+		client: client,
+		remote: remote,
+	}
+
+	resp, err := u.request("POST", "/u", nil, header)
+	if err != nil {
+		return nil, fmt.Errorf("error creating upload session: %v", err)
+	}
+	sid, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %v", err)
+	}
+	u.sid = string(sid)
+
+	chunk := make([]byte, uploadChunkSize)
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(data, chunk)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+
+		if err = u.putChunk(index, chunk[:n]); err != nil {
+			return nil, fmt.Errorf("error uploading chunk %d: %v", index, err)
+		}
+	}
+
+	resp, err = u.request("POST", "/u/"+u.sid, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error finalizing upload: %v", err)
+	}
+	return resp, nil
+}
+
+func (u *Upload) putChunk(index uint64, chunk []byte) error {
+	path := fmt.Sprintf("/u/%s/%d", u.sid, index)
+
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			// The chunk may have been received even though the response was lost.
+			status, err := u.status()
+			if err == nil && status.Chunks > index {
+				return nil
+			}
+		}
+
+		resp, err := u.attempt("PUT", path, chunk, nil)
+		if err == nil {
+			resp.Body.Close()
+			return nil
+		}
+		if !isRetryable(resp, err) || attempt == maxUploadAttempts {
+			return err
+		}
+
+		u.backoff(attempt, err)
+	}
+}
+
+func (u *Upload) status() (*lib.UploadStatusPayload, error) {
+	resp, err := u.attempt("GET", "/u/"+u.sid, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var status lib.UploadStatusPayload
+	if err = json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Sends a request that is safe to repeat, retrying after network errors and server failures.
+func (u *Upload) request(method string, path string, body []byte, header http.Header) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := u.attempt(method, path, body, header)
+		if err == nil {
+			return resp, nil
+		}
+		if !isRetryable(resp, err) || attempt == maxUploadAttempts {
+			return nil, err
+		}
+
+		u.backoff(attempt, err)
+	}
+}
+
+func (u *Upload) attempt(method string, path string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.remote+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/octet-stream")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := makeAuthenticatedRequestInternal(u.client, req, u.remote)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return resp, fmt.Errorf("request failed with status: %s", resp.Status)
+	}
+	return resp, nil
+}
+
+func (u *Upload) backoff(attempt int, err error) {
+	delay := uploadRetryDelay << uint(attempt-1)
+	fmt.Fprintf(os.Stderr, "WARN: Upload interrupted (%v), resuming in %v ...\n", err, delay)
+	time.Sleep(delay)
+}
+
+// Network errors and server failures are worth retrying, while any other rejection will not change.
+func isRetryable(resp *http.Response, err error) bool {
+	if resp != nil {
+		return resp.StatusCode >= 500 && resp.StatusCode != http.StatusInsufficientStorage
+	}
+	_, isNetworkErr := err.(*url.Error)
+	return isNetworkErr
+}
+
+func dropHeader(ttl time.Duration, maxPulls int) http.Header {
+	header := http.Header{}
+	if ttl > 0 {
+		header.Set(lib.TTLHeader, strconv.FormatInt(int64((ttl+time.Second-1)/time.Second), 10))
+	}
+	if maxPulls >= 0 {
+		header.Set(lib.MaxPullsHeader, strconv.Itoa(maxPulls))
+	}
+	return header
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"dead-drop/lib"
+	"encoding/json"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Serves just enough of the upload api, dropping the connection of the first few requests to each endpoint.
+type flakyServer struct {
+	lock     sync.Mutex
+	failures map[string]int
+	chunks   uint64
+}
+
+func (fs *flakyServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	endpoint := req.Method + " " + req.URL.Path
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.failures[endpoint] > 0 {
+		fs.failures[endpoint]--
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+		return
+	}
+
+	w.Header().Set(lib.NonceHeader, "nonce")
+	switch endpoint {
+	case "GET /challenge":
+		w.Write([]byte("nonce"))
+	case "POST /u":
+		w.Write([]byte("sid"))
+	case "GET /u/sid":
+		json.NewEncoder(w).Encode(&lib.UploadStatusPayload{Chunks: fs.chunks})
+	case "PUT /u/sid/0":
+		ioutil.ReadAll(req.Body)
+		fs.chunks++
+	case "POST /u/sid":
+		w.Write([]byte("oid"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestUploadRetriesNetworkErrors(t *testing.T) {
+	privKey, err := generateKey(ed25519KeyType)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	signerCache.signer = &keySigner{privKey: privKey}
+	defer func() { signerCache.signer = nil }()
+	viper.Set(keyNameFlag, "test")
+
+	oldDelay := uploadRetryDelay
+	uploadRetryDelay = time.Millisecond
+	defer func() { uploadRetryDelay = oldDelay }()
+
+	// The upload starts without a nonce, so the first attempts fail while fetching one, and the chunk
+	// fails after its nonce has been spent.
+	fake := &flakyServer{
+		failures: map[string]int{
+			"GET /challenge": 3,
+			"PUT /u/sid/0":   1,
+		},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	resp, err := upload(server.Client(), server.URL, strings.NewReader("data"), nil)
+	if err != nil {
+		t.Fatalf("Expected upload to survive network errors, got: %v", err)
+	}
+	defer resp.Body.Close()
+
+	oid, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(oid) != "oid" {
+		t.Fatalf("Expected oid from finalized upload, got %q: %v", oid, err)
+	}
+	if fake.chunks != 1 {
+		t.Fatalf("Expected the chunk to be received once, got %d", fake.chunks)
+	}
+}
+
+func TestUploadDoesNotRetryRejections(t *testing.T) {
+	statuses := map[int]bool{
+		http.StatusRequestEntityTooLarge: false,
+		http.StatusConflict:              false,
+		http.StatusUnauthorized:          false,
+		http.StatusInsufficientStorage:   false,
+		http.StatusInternalServerError:   true,
+		http.StatusBadGateway:            true,
+	}
+	for status, retryable := range statuses {
+		if isRetryable(&http.Response{StatusCode: status}, nil) != retryable {
+			t.Fatalf("Expected status %d to be retryable: %v", status, retryable)
+		}
+	}
+}
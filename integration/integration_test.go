@@ -1,9 +1,169 @@
 package integration
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
+// A testEnv runs the server and client binaries against each other, in a scratch directory which also serves as HOME.
+// The server is built from this tree, so server/generated.go must exist (`make test` generates it).
+type testEnv struct {
+	t      *testing.T
+	dir    string
+	server *exec.Cmd
+	logs   *bytes.Buffer
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	dir, err := ioutil.TempDir("", "dead-drop-integration")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	env := &testEnv{t: t, dir: dir, logs: new(bytes.Buffer)}
+
+	for _, pkg := range []string{"client", "server"} {
+		build := exec.Command("go", "build", "-o", env.path(pkg), "dead-drop/"+pkg)
+		if out, err := build.CombinedOutput(); err != nil {
+			env.close()
+			t.Fatalf("Failed to build %s: %v\n%s", pkg, err, out)
+		}
+	}
+
+	if err := os.Mkdir(env.path("keys"), 0700); err != nil {
+		env.close()
+		t.Fatalf("Failed to create keys directory: %v", err)
+	}
+	env.writeCertificate()
+
+	addr := freeAddr(t)
+	env.writeFile("server.yml", fmt.Sprintf(
+		"addr: %s\ndata-dir: %s\nkeys-dir: %s\ntls-cert: %s\ntls-key: %s\n",
+		addr, env.path("data"), env.path("keys"), env.path("server.crt"), env.path("server.key"),
+	))
+	env.writeFile("client.yml", fmt.Sprintf(
+		"remote: https://%s\nprivate-key: %s\nencryption-key: %s\nkey-name: root\ninsecure-skip-verify: true\n",
+		addr, env.path("private.pem"), env.path("enc.key"),
+	))
+
+	// The server looks for its assets relative to the working directory when they are not generated into it.
+	env.server = exec.Command(env.path("server"), "--config", env.path("server.yml"))
+	env.server.Dir = filepath.Join("..", "server")
+	env.server.Env = append(os.Environ(), "HOME="+dir)
+	env.server.Stdout = env.logs
+	env.server.Stderr = env.logs
+	if err := env.server.Start(); err != nil {
+		env.close()
+		t.Fatalf("Failed to start server: %v", err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if attempt == 100 {
+			env.close()
+			t.Fatalf("Server did not start listening on %s:\n%s", addr, env.logs)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return env
+}
+
+func (env *testEnv) close() {
+	if env.server != nil && env.server.Process != nil {
+		_ = env.server.Process.Kill()
+		_ = env.server.Wait()
+	}
+	_ = os.RemoveAll(env.dir)
+}
+
+func (env *testEnv) path(name string) string {
+	return filepath.Join(env.dir, name)
+}
+
+func (env *testEnv) writeFile(name string, contents string) {
+	if err := ioutil.WriteFile(env.path(name), []byte(contents), 0600); err != nil {
+		env.t.Fatalf("Failed to write %s: %v", name, err)
+	}
+}
+
+// Runs the client with the test configuration, and returns what it wrote to stdout.
+func (env *testEnv) client(args ...string) string {
+	cmd := exec.Command(env.path("client"), append(args, "--config", env.path("client.yml"))...)
+	cmd.Dir = env.dir
+	cmd.Env = append(os.Environ(), "HOME="+env.dir)
+
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		env.t.Fatalf("Client failed to %s: %v\n%s\nServer logs:\n%s", args[0], err, stderr, env.logs)
+	}
+	return string(out)
+}
+
+// Generates a key for the client, and authorizes it on the server as root.
+func (env *testEnv) setupClient() {
+	env.client("gen-key", env.path("private.pem"), env.path("keys/root"), "--type", "ed25519", "--no-passphrase")
+	env.writeFile("enc.key", "integration test secret")
+}
+
+func (env *testEnv) writeCertificate() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		env.t.Fatalf("Failed to generate tls key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		env.t.Fatalf("Failed to create tls certificate: %v", err)
+	}
+
+	env.writeFile("server.crt", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})))
+	env.writeFile("server.key", string(pem.EncodeToMemory(
+		&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)},
+	)))
+}
+
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
 func TestSimpleDropPull(t *testing.T) {
 	// TODO(shane)
 }
@@ -48,8 +208,28 @@ func TestTLSCertificateVerification(t *testing.T) {
 	// TODO(shane)
 }
 
+// Large objects are uploaded in several chunks, and must come back intact.
 func TestLargeObjects(t *testing.T) {
-	// TODO(shane)
+	env := newTestEnv(t)
+	defer env.close()
+	env.setupClient()
+
+	data := make([]byte, 20<<20+12345)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("Failed to generate object: %v", err)
+	}
+	env.writeFile("large", string(data))
+
+	reference := strings.TrimSpace(env.client("drop", env.path("large")))
+	env.client("pull", reference, env.path("pulled"))
+
+	pulled, err := ioutil.ReadFile(env.path("pulled"))
+	if err != nil {
+		t.Fatalf("Failed to read pulled object: %v", err)
+	}
+	if !bytes.Equal(pulled, data) {
+		t.Fatalf("Pulled object does not match dropped object (%d of %d bytes)", len(pulled), len(data))
+	}
 }
 
 func TestManyObjects(t *testing.T) {
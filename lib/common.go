@@ -8,12 +8,24 @@ const DefaultConfigDir = ".dead-drop"
 const DefaultConfigName = "conf"
 const DefaultConfigType = "yml"
 
-const TokenCipherLabel = "token"
+// Key names may contain '@' and '.' so that the comments of OpenSSH keys (e.g. alice@laptop) can be used as names, but
+// cannot start with '.', since they are also file names in the keys directory.
+const KeyNameRegex = "^[a-zA-Z0-9_@-][a-zA-Z0-9_@.-]{0,63}$"
 
-const KeyNameRegex = "^[a-zA-Z0-9_-]{1,64}$"
+// The requested and effective lifetime of a dropped object, or its remaining lifetime, in seconds.
+const TTLHeader = "X-Dead-Drop-TTL"
 
-type TokenRequestPayload struct {
-	KeyName string
+// The number of pulls after which a dropped object is destroyed, zero for unlimited pulls.
+const MaxPullsHeader = "X-Dead-Drop-Max-Pulls"
+
+// The number of pulls a dropped object has left before it is destroyed.
+const PullsRemainingHeader = "X-Dead-Drop-Pulls-Remaining"
+
+// The number of chunks and bytes received by an upload session, and its oid once finalized.
+type UploadStatusPayload struct {
+	Chunks uint64
+	Offset int64
+	Oid    string
 }
 
 type AddKeyPayload struct {
@@ -0,0 +1,199 @@
+package lib
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"strings"
+)
+
+// Signatures are made over a message prefixed by its purpose, so a signature cannot be reused for another purpose.
+const RequestSignatureLabel = "dead-drop request"
+
+// Requests are authenticated by signing them with a nonce from the server, given in the Authorization header as
+// `Dead-Drop-Signature KeyName=<key name>, Nonce=<nonce>, Signature=<base64 signature>`, with `, Format=ssh` appended
+// for signatures made by ssh-agent (see VerifySSHSignature).
+const SignatureScheme = "Dead-Drop-Signature"
+
+const SSHSignatureFormat = "ssh"
+
+// Every response to an authenticated request carries a fresh nonce, which can be used to sign the next request.
+const NonceHeader = "X-Dead-Drop-Nonce"
+
+// The hex SHA-256 digest of a signed request's body.
+const ContentHashHeader = "X-Dead-Drop-Content-SHA256"
+
+func RequestSignatureMessage(keyName string, nonce string, method string, path string, contentHash string) []byte {
+	return []byte(strings.Join([]string{RequestSignatureLabel, keyName, nonce, method, path, contentHash}, "\n"))
+}
+
+type RequestSignature struct {
+	KeyName   string
+	Nonce     string
+	Signature []byte
+	Format    string
+}
+
+func (sig *RequestSignature) String() string {
+	authorization := fmt.Sprintf(
+		"%s KeyName=%s, Nonce=%s, Signature=%s",
+		SignatureScheme, sig.KeyName, sig.Nonce, base64.StdEncoding.EncodeToString(sig.Signature),
+	)
+	if sig.Format != "" {
+		authorization += ", Format=" + sig.Format
+	}
+	return authorization
+}
+
+func ParseRequestSignature(authorization string) (*RequestSignature, error) {
+	if !strings.HasPrefix(authorization, SignatureScheme+" ") {
+		return nil, fmt.Errorf("not a %s authorization", SignatureScheme)
+	}
+
+	params := make(map[string]string)
+	for _, param := range strings.Split(strings.TrimPrefix(authorization, SignatureScheme+" "), ", ") {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed authorization parameter '%s'", param)
+		}
+		params[parts[0]] = parts[1]
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(params["Signature"])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %v", err)
+	}
+	if params["KeyName"] == "" || params["Nonce"] == "" || len(signature) == 0 {
+		return nil, fmt.Errorf("incomplete authorization")
+	}
+
+	return &RequestSignature{
+		KeyName:   params["KeyName"],
+		Nonce:     params["Nonce"],
+		Signature: signature,
+		Format:    params["Format"],
+	}, nil
+}
+
+// Authorized keys are either PKCS#1 RSA public keys, PKIX public keys (RSA, P-256 ECDSA, or Ed25519), or OpenSSH
+// public keys of the same algorithms (e.g. id_ed25519.pub).
+func ParsePublicKey(keyBytes []byte) (crypto.PublicKey, error) {
+	keyDer, _ := pem.Decode(keyBytes)
+	if keyDer == nil {
+		if key, _, err := ParseAuthorizedKey(keyBytes); err == nil {
+			return key, nil
+		}
+		return nil, fmt.Errorf("failed to decode pem bytes")
+	}
+
+	switch keyDer.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(keyDer.Bytes)
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(keyDer.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return key, checkKeyType(key)
+	default:
+		return nil, fmt.Errorf("unsupported public key type '%s'", keyDer.Type)
+	}
+}
+
+// Parses a single line of an OpenSSH authorized_keys file, returning the key and its comment.
+func ParseAuthorizedKey(line []byte) (crypto.PublicKey, string, error) {
+	sshKey, comment, _, _, err := ssh.ParseAuthorizedKey(line)
+	if err != nil {
+		return nil, "", err
+	}
+
+	key, err := CryptoPublicKey(sshKey)
+	return key, comment, err
+}
+
+func CryptoPublicKey(sshKey ssh.PublicKey) (crypto.PublicKey, error) {
+	cryptoKey, ok := sshKey.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported ssh key type '%s'", sshKey.Type())
+	}
+
+	key := cryptoKey.CryptoPublicKey()
+	return key, checkKeyType(key)
+}
+
+func checkKeyType(key crypto.PublicKey) error {
+	switch key := key.(type) {
+	case *rsa.PublicKey, ed25519.PublicKey:
+		return nil
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return fmt.Errorf("unsupported ecdsa curve %s", key.Curve.Params().Name)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key algorithm %T", key)
+	}
+}
+
+// Ed25519 keys sign messages directly, while ECDSA and RSA (PSS) keys sign their SHA-256 digest.
+func Sign(signer crypto.Signer, message []byte) ([]byte, error) {
+	switch signer.Public().(type) {
+	case ed25519.PublicKey:
+		return signer.Sign(rand.Reader, message, crypto.Hash(0))
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(message)
+		return signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(message)
+		opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+		return signer.Sign(rand.Reader, digest[:], opts)
+	default:
+		return nil, fmt.Errorf("unsupported private key algorithm %T", signer.Public())
+	}
+}
+
+func VerifySignature(key crypto.PublicKey, message []byte, signature []byte) bool {
+	digest := sha256.Sum256(message)
+
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, message, signature)
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, digest[:], signature)
+	case *rsa.PublicKey:
+		opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+		return rsa.VerifyPSS(key, crypto.SHA256, digest[:], signature, opts) == nil
+	default:
+		return false
+	}
+}
+
+// Agents sign in the SSH wire format, which is verified by the ssh package. RSA signatures must use SHA-256 or
+// SHA-512, rather than the SHA-1 of plain ssh-rsa signatures.
+func VerifySSHSignature(key crypto.PublicKey, message []byte, signature []byte) bool {
+	sig := new(ssh.Signature)
+	if err := ssh.Unmarshal(signature, sig); err != nil {
+		return false
+	}
+
+	switch sig.Format {
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.SigAlgoRSASHA2256, ssh.SigAlgoRSASHA2512:
+	default:
+		return false
+	}
+
+	sshKey, err := ssh.NewPublicKey(key)
+	if err != nil {
+		return false
+	}
+	return sshKey.Verify(message, sig) == nil
+}
@@ -1,41 +1,64 @@
 package main
 
 import (
+	"crypto"
+	"crypto/hmac"
 	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha512"
-	"crypto/x509"
+	"crypto/sha256"
 	"dead-drop/lib"
-	"encoding/pem"
+	"encoding/hex"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/google/logger"
 	"github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh"
+	"hash"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"os"
 	"path/filepath"
 	"sync"
 	"time"
 )
 
 const UnauthorizedErr = Error("math: square root of negative number")
+const BodyMismatchErr = Error("request body does not match its signed hash")
+
+const challengeTTL = 10 * time.Second
 
 type Authenticator struct {
-	secret            []byte
-	secretLock        sync.RWMutex
-	authorizedKeysDir string
+	secret             []byte
+	secretLock         sync.RWMutex
+	authorizedKeysDir  string
+	authorizedKeysFile string
+
+	// Challenges which have been spent, guarded by secretLock. Challenges signed with an old secret are no longer
+	// valid, so these are forgotten whenever the secret rotates.
+	usedChallenges map[string]bool
 }
 
-func newAuthenticator(authorizedKeysDirPath string) *Authenticator {
+func newAuthenticator(authorizedKeysDirPath string, authorizedKeysFilePath string) *Authenticator {
 	authorizedKeysDir, err := homedir.Expand(authorizedKeysDirPath)
 	if err != nil {
-		logger.Fatalf("Failed to expand authorized keys file path: %v", err)
+		logger.Fatalf("Failed to expand authorized keys directory path: %v", err)
 	}
 
 	logger.Infof("Starting authenticator with authorized-keys directory %s", authorizedKeysDir)
 
+	var authorizedKeysFile string
+	if authorizedKeysFilePath != "" {
+		if authorizedKeysFile, err = homedir.Expand(authorizedKeysFilePath); err != nil {
+			logger.Fatalf("Failed to expand authorized keys file path: %v", err)
+		}
+		logger.Infof("Using authorized_keys file %s", authorizedKeysFile)
+	}
+
 	authenticator := &Authenticator{
-		secret:            newSecret(),
-		authorizedKeysDir: authorizedKeysDir,
+		secret:             newSecret(),
+		authorizedKeysDir:  authorizedKeysDir,
+		authorizedKeysFile: authorizedKeysFile,
+		usedChallenges:     make(map[string]bool),
 	}
 
 	go authenticator.secretRotator()
@@ -51,54 +74,111 @@ func (auth *Authenticator) secretRotator() {
 
 		auth.secretLock.Lock()
 		auth.secret = newSecret()
+		auth.usedChallenges = make(map[string]bool)
 		auth.secretLock.Unlock()
 	}
 }
 
-func (auth *Authenticator) generateToken(pkeyBytes []byte) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.MapClaims{
-		"ran": auth.randomClaim(),
-		"exp": time.Now().Add(time.Second).Unix(),
-	})
+// Requests are signed along with a challenge from the server (the nonce), which can only be spent once, so a signed
+// request cannot be replayed. The signature covers the hash of the body, which is checked as the body is read, so
+// handlers must read the body to EOF before acting on it.
+// Returns the name of the key which signed the request, if the signature is valid.
+func (auth *Authenticator) verifyRequest(req *http.Request) (string, bool) {
+	sig, err := lib.ParseRequestSignature(req.Header.Get("Authorization"))
+	if err != nil || !keyNameRegex.Match([]byte(sig.KeyName)) {
+		return "", false
+	}
 
-	auth.secretLock.RLock()
-	signedToken, err := token.SignedString(auth.secret)
+	contentHash := req.Header.Get(lib.ContentHashHeader)
+	expectedDigest, err := hex.DecodeString(contentHash)
+	if err != nil || len(expectedDigest) != sha256.Size {
+		return "", false
+	}
+
+	pkey, err := auth.getAuthorizedKey(sig.KeyName)
 	if err != nil {
-		return "", err
+		logger.Errorf("Failed to load authorized key: %v", err)
+		return "", false
 	}
-	auth.secretLock.RUnlock()
 
-	pkeyDer, _ := pem.Decode(pkeyBytes)
-	if pkeyDer == nil {
-		logger.Errorf("Failed to decode pem bytes")
-		return "", UnauthorizedErr
+	message := lib.RequestSignatureMessage(sig.KeyName, sig.Nonce, req.Method, req.URL.RequestURI(), contentHash)
+	var ok bool
+	switch sig.Format {
+	case "":
+		ok = lib.VerifySignature(pkey, message, sig.Signature)
+	case lib.SSHSignatureFormat:
+		ok = lib.VerifySSHSignature(pkey, message, sig.Signature)
 	}
-	pkey, err := x509.ParsePKCS1PublicKey(pkeyDer.Bytes)
-	if err != nil {
-		logger.Errorf("Failed to parse public key: %v", err)
-		return "", UnauthorizedErr
+	if !ok {
+		return "", false
+	}
+	// The nonce is only spent once the signature is verified, so nobody else can spend it.
+	if !auth.spendChallenge(sig.Nonce) {
+		return "", false
 	}
 
-	ciphertext, err := rsa.EncryptOAEP(sha512.New(), rand.Reader, pkey, []byte(signedToken), []byte(lib.TokenCipherLabel))
-	return string(ciphertext), err
+	req.Body = &verifiedBody{ReadCloser: req.Body, digest: sha256.New(), expected: expectedDigest}
+	return sig.KeyName, true
+}
+
+// Fails the final read of a request body if it does not match the hash that was signed.
+type verifiedBody struct {
+	io.ReadCloser
+	digest   hash.Hash
+	expected []byte
 }
 
-func (auth *Authenticator) validateToken(tokenString string) bool {
+func (body *verifiedBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	body.digest.Write(p[:n])
+	if err == io.EOF && !hmac.Equal(body.digest.Sum(nil), body.expected) {
+		return n, BodyMismatchErr
+	}
+	return n, err
+}
+
+// Challenges are signed by the server, so they do not need to be stored, and expire quickly so they cannot be
+// collected for later use.
+func (auth *Authenticator) generateChallenge() (string, error) {
+	challenge := jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.MapClaims{
+		"ran": auth.randomClaim(),
+		"use": "challenge",
+		"exp": time.Now().Add(challengeTTL).Unix(),
+	})
+
 	auth.secretLock.RLock()
+	defer auth.secretLock.RUnlock()
+	return challenge.SignedString(auth.secret)
+}
+
+func (auth *Authenticator) spendChallenge(challengeString string) bool {
+	auth.secretLock.Lock()
+	defer auth.secretLock.Unlock()
+
+	claims, ok := parseClaims(challengeString, auth.secret)
+	if !ok || claims["use"] != "challenge" || auth.usedChallenges[challengeString] {
+		return false
+	}
+
+	auth.usedChallenges[challengeString] = true
+	return true
+}
+
+// The caller must hold the secret lock.
+func parseClaims(tokenString string, secret []byte) (jwt.MapClaims, bool) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 
-		return auth.secret, nil
+		return secret, nil
 	})
-	auth.secretLock.RUnlock()
 	if err != nil {
-		return false
+		return nil, false
 	}
 
-	_, ok := token.Claims.(jwt.MapClaims)
-	return ok && token.Valid
+	claims, ok := token.Claims.(jwt.MapClaims)
+	return claims, ok && token.Valid
 }
 
 func (auth *Authenticator) randomClaim() string {
@@ -117,8 +197,49 @@ func (auth *Authenticator) randomClaim() string {
 	return string(bytes)
 }
 
-func (auth *Authenticator) getAuthorizedKey(keyName string) ([]byte, error) {
-	return ioutil.ReadFile(filepath.Join(auth.authorizedKeysDir, keyName))
+// Keys are looked up in the authorized-keys directory first, and then in the authorized_keys file (if any).
+// Both are read on every lookup, so keys can be added and removed without restarting the server.
+func (auth *Authenticator) getAuthorizedKey(keyName string) (crypto.PublicKey, error) {
+	keyBytes, err := ioutil.ReadFile(filepath.Join(auth.authorizedKeysDir, keyName))
+	if err == nil {
+		return lib.ParsePublicKey(keyBytes)
+	}
+	if !os.IsNotExist(err) || auth.authorizedKeysFile == "" {
+		return nil, err
+	}
+
+	return auth.findAuthorizedKey(keyName)
+}
+
+// The authorized_keys file uses the OpenSSH format, with the comment of each key as its name. Keys with options
+// (e.g. from= or command=) are skipped, since their restrictions cannot be honoured.
+func (auth *Authenticator) findAuthorizedKey(keyName string) (crypto.PublicKey, error) {
+	rest, err := ioutil.ReadFile(auth.authorizedKeysFile)
+	if err != nil {
+		return nil, err
+	}
+
+	for len(rest) > 0 {
+		var sshKey ssh.PublicKey
+		var comment string
+		var options []string
+		sshKey, comment, options, rest, err = ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			// Only fails once there are no more keys in the file.
+			break
+		}
+		if comment != keyName {
+			continue
+		}
+		if len(options) > 0 {
+			logger.Warningf("Skipping authorized key %s, which has options", keyName)
+			continue
+		}
+
+		return lib.CryptoPublicKey(sshKey)
+	}
+
+	return nil, fmt.Errorf("no authorized key named %s", keyName)
 }
 
 func (auth *Authenticator) addAuthorizedKey(key []byte, keyName string) error {
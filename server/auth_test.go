@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"dead-drop/lib"
+	"encoding/hex"
+	"encoding/pem"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func marshalTestKey(t *testing.T, key crypto.PublicKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func newTestAuthenticator(t *testing.T) (*Authenticator, func()) {
+	keysDir, err := ioutil.TempDir("", "dead-drop-keys")
+	if err != nil {
+		t.Fatalf("Failed to create keys directory: %v", err)
+	}
+
+	auth := &Authenticator{secret: newSecret(), authorizedKeysDir: keysDir, usedChallenges: make(map[string]bool)}
+	return auth, func() {
+		_ = os.RemoveAll(keysDir)
+	}
+}
+
+func signedTestRequest(
+	t *testing.T, auth *Authenticator, signer crypto.Signer, method string, path string, body []byte,
+) *http.Request {
+	nonce, err := auth.generateChallenge()
+	if err != nil {
+		t.Fatalf("Failed to generate nonce: %v", err)
+	}
+
+	digest := sha256.Sum256(body)
+	contentHash := hex.EncodeToString(digest[:])
+
+	signature, err := lib.Sign(signer, lib.RequestSignatureMessage("alice", nonce, method, path, contentHash))
+	if err != nil {
+		t.Fatalf("Failed to sign request: %v", err)
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Authorization", (&lib.RequestSignature{KeyName: "alice", Nonce: nonce, Signature: signature}).String())
+	req.Header.Set(lib.ContentHashHeader, contentHash)
+	return req
+}
+
+func TestVerifyRequest(t *testing.T) {
+	auth, cleanup := newTestAuthenticator(t)
+	defer cleanup()
+
+	_, signer, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	if err := auth.addAuthorizedKey(marshalTestKey(t, signer.Public()), "alice"); err != nil {
+		t.Fatalf("Failed to add key: %v", err)
+	}
+
+	req := signedTestRequest(t, auth, signer, "PUT", "/u/abc/0", []byte("chunk"))
+	replay := req.Clone(req.Context())
+	replay.Body = ioutil.NopCloser(bytes.NewReader([]byte("chunk")))
+
+	if keyName, ok := auth.verifyRequest(req); !ok || keyName != "alice" {
+		t.Fatalf("Expected request to be signed by alice, got %s", keyName)
+	}
+	if body, err := ioutil.ReadAll(req.Body); err != nil || string(body) != "chunk" {
+		t.Fatalf("Failed to read verified body: %v", err)
+	}
+	if _, ok := auth.verifyRequest(replay); ok {
+		t.Fatalf("Expected a replayed request to be rejected")
+	}
+
+	req = signedTestRequest(t, auth, signer, "DELETE", "/d/abc", nil)
+	req.URL.Path = "/d/xyz"
+	if _, ok := auth.verifyRequest(req); ok {
+		t.Fatalf("Expected a request with a different path to be rejected")
+	}
+
+	req = signedTestRequest(t, auth, signer, "PUT", "/u/abc/0", []byte("chunk"))
+	req.Body = ioutil.NopCloser(bytes.NewReader([]byte("evil!")))
+	if _, ok := auth.verifyRequest(req); !ok {
+		t.Fatalf("Expected request to be signed by alice")
+	}
+	if _, err := ioutil.ReadAll(req.Body); err != BodyMismatchErr {
+		t.Fatalf("Expected a different body to fail verification, got %v", err)
+	}
+
+	req = signedTestRequest(t, auth, signer, "GET", "/d/abc", nil)
+	req.Header.Set("Authorization", strings.Replace(req.Header.Get("Authorization"), "alice", "bob", 1))
+	if _, ok := auth.verifyRequest(req); ok {
+		t.Fatalf("Expected a request signed for another key to be rejected")
+	}
+
+	// Bearer tokens are not tied to a request, so they are never accepted.
+	token, err := auth.generateChallenge()
+	if err != nil {
+		t.Fatalf("Failed to generate challenge: %v", err)
+	}
+	req = httptest.NewRequest("GET", "/d/abc", nil)
+	req.Header.Set("Authorization", token)
+	if _, ok := auth.verifyRequest(req); ok {
+		t.Fatalf("Expected an unsigned request to be rejected")
+	}
+
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	if _, err := lib.ParsePublicKey(marshalTestKey(t, p384Key.Public())); err == nil {
+		t.Fatalf("Expected ecdsa keys on curves other than P-256 to be rejected")
+	}
+}
+
+func TestAuthorizedKeysFile(t *testing.T) {
+	auth, cleanup := newTestAuthenticator(t)
+	defer cleanup()
+
+	var lines []string
+	keys := make(map[string]crypto.PublicKey)
+	for _, name := range []string{"alice@laptop", "bob", "restricted"} {
+		pkey, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("Failed to generate key: %v", err)
+		}
+		sshKey, err := ssh.NewPublicKey(pkey)
+		if err != nil {
+			t.Fatalf("Failed to convert key: %v", err)
+		}
+
+		line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshKey))) + " " + name
+		if name == "restricted" {
+			line = `command="/bin/false" ` + line
+		}
+		lines = append(lines, "# "+name, line)
+		keys[name] = pkey
+	}
+
+	auth.authorizedKeysFile = filepath.Join(auth.authorizedKeysDir, "authorized_keys")
+	if err := ioutil.WriteFile(auth.authorizedKeysFile, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatalf("Failed to write authorized_keys: %v", err)
+	}
+
+	for _, name := range []string{"alice@laptop", "bob"} {
+		pkey, err := auth.getAuthorizedKey(name)
+		if err != nil {
+			t.Fatalf("Failed to find key %s: %v", name, err)
+		}
+		if !bytes.Equal(pkey.(ed25519.PublicKey), keys[name].(ed25519.PublicKey)) {
+			t.Fatalf("Found the wrong key for %s", name)
+		}
+	}
+	if _, err := auth.getAuthorizedKey("restricted"); err == nil {
+		t.Fatalf("Expected a key with options to be skipped")
+	}
+	if _, err := auth.getAuthorizedKey("carol"); err == nil {
+		t.Fatalf("Expected an unknown key to not be found")
+	}
+
+	// Keys in the keys directory take precedence over the authorized_keys file.
+	if err := auth.addAuthorizedKey(marshalTestKey(t, keys["alice@laptop"]), "bob"); err != nil {
+		t.Fatalf("Failed to add key: %v", err)
+	}
+	pkey, err := auth.getAuthorizedKey("bob")
+	if err != nil || !bytes.Equal(pkey.(ed25519.PublicKey), keys["alice@laptop"].(ed25519.PublicKey)) {
+		t.Fatalf("Expected the key from the keys directory (%v)", err)
+	}
+}
@@ -3,12 +3,8 @@ package main
 import (
 	"container/heap"
 	"crypto/rand"
-	"dead-drop/lib"
 	"github.com/google/logger"
-	"github.com/mitchellh/go-homedir"
-	"io/ioutil"
-	"os"
-	"path/filepath"
+	"io"
 	"sync"
 	"time"
 )
@@ -17,33 +13,61 @@ import (
 const heapCleanThresholdNumber = 4096
 const heapCleanThresholdPercent = 0.5
 
-func initDatabase(dataDirPath string, ttlMin uint, destructiveRead bool) *Database {
-	dataDir, err := createDataDir(dataDirPath)
-	if err != nil {
-		logger.Fatalf("Failed to create data directory: %v", err)
+const NotOwnerErr = Error("object was dropped by another key")
+
+// Objects in storage that is not persistent do not survive restarts, so neither does their metadata, and the data
+// directory is not used. Otherwise the data directory must already exist (see initStorage).
+func initDatabase(dataDir string, storage Storage, ttlMin uint, maxTTLMin uint, defaultMaxPulls uint) *Database {
+	if storage.persistent() {
+		logger.Infof("Starting database with data directory %s", dataDir)
+	} else {
+		logger.Infof("Starting database in memory")
 	}
 
-	logger.Infof("Starting database with data directory %s", dataDir)
+	defaultTTL := time.Duration(ttlMin) * time.Minute
+	maxTTL := time.Duration(maxTTLMin) * time.Minute
+	if defaultTTL > maxTTL {
+		logger.Warningf("Default ttl exceeds maximum ttl, objects will expire after %v", maxTTL)
+		defaultTTL = maxTTL
+	}
 
-	objectMap := make(map[string]bool)
+	objectMap := make(map[string]*ObjectInfo)
 	expHeap := &ExpirationHeap{}
-	if err = indexDataDir(objectMap, expHeap, &dataDir); err != nil {
-		logger.Fatalf("Failed to index data directory: %v", err)
+	journal := &Journal{}
+	if storage.persistent() {
+		journaled, removed, err := replayJournal(dataDir)
+		if err != nil {
+			logger.Fatalf("Failed to replay journal: %v", err)
+		}
+
+		if err = indexStorage(objectMap, expHeap, storage, journaled, removed, defaultTTL, defaultMaxPulls); err != nil {
+			logger.Fatalf("Failed to index stored objects: %v", err)
+		}
+		heap.Init(expHeap)
+
+		if journal, err = openJournal(dataDir, objectMap, removed); err != nil {
+			logger.Fatalf("Failed to open journal: %v", err)
+		}
 	}
-	heap.Init(expHeap)
 
 	lock := &sync.RWMutex{}
 
 	db := &Database{
 		lock:             lock,
 		objectMap:        objectMap,
+		pendingOids:      make(map[string]bool),
+		openingPulls:     make(map[string]uint),
+		deferredRemovals: make(map[string]bool),
+		uploads:          make(map[string]*UploadSession),
 		expHeap:          expHeap,
 		heapCleanCond:    sync.NewCond(lock),
 		dirtyHeapBlocks:  0,
 		heapCleanPending: false,
-		dataDir:          dataDir,
-		ttlMin:           ttlMin,
-		destructiveRead:  destructiveRead,
+		storage:          storage,
+		journal:          journal,
+		defaultTTL:       defaultTTL,
+		maxTTL:           maxTTL,
+		defaultMaxPulls:  defaultMaxPulls,
 	}
 
 	go db.expiryJob()
@@ -51,30 +75,67 @@ func initDatabase(dataDirPath string, ttlMin uint, destructiveRead bool) *Databa
 	return db
 }
 
-func createDataDir(path string) (string, error) {
-	dataDir, err := homedir.Expand(path)
+// Reconciles the journaled metadata against the objects in storage.
+// Objects missing from the journal fall back to the default ttl and pull limit, starting from their modification time.
+// Objects the journal says were removed are removed from storage again, and their tombstones are only kept until then.
+func indexStorage(
+	objectMap map[string]*ObjectInfo,
+	expHeap *ExpirationHeap,
+	storage Storage,
+	journaled map[string]*ObjectInfo,
+	removed map[string]bool,
+	ttl time.Duration,
+	maxPulls uint,
+) error {
+	logger.Infof("Indexing storage for existing objects")
+
+	stored, err := storage.list()
 	if err != nil {
-		return "", err
+		return err
 	}
-	return dataDir, os.MkdirAll(dataDir, 0770)
-}
 
-func indexDataDir(objectMap map[string]bool, expHeap *ExpirationHeap, dataDir *string) error {
-	logger.Infof("Indexing data directory for existing objects")
+	lingering := make(map[string]bool)
+	for _, so := range stored {
+		oid := so.oid
 
-	files, err := ioutil.ReadDir(*dataDir)
-	if err != nil {
-		return err
+		if removed[oid] {
+			logger.Infof("Removing object %s, which was removed before the restart", oid)
+			if err := storage.remove(oid); err != nil {
+				logger.Errorf("Failed to remove object %s: %v", oid, err)
+				lingering[oid] = true
+			}
+			continue
+		}
+
+		oi, ok := journaled[oid]
+		if !ok {
+			logger.Warningf("Object %s is missing from the journal, using default metadata", oid)
+			oi = &ObjectInfo{
+				created:        so.modified,
+				expires:        so.modified.Add(ttl),
+				maxPulls:       maxPulls,
+				pullsRemaining: maxPulls,
+				oid:            oid,
+			}
+		} else if oi.size != so.size {
+			logger.Warningf("Object %s has size %d in storage, but %d in the journal", oid, so.size, oi.size)
+		}
+		oi.size = so.size
+
+		objectMap[oid] = oi
+		expHeap.Push(oi)
 	}
 
-	for _, file := range files {
-		oid := file.Name()
+	for oid := range journaled {
+		if _, ok := objectMap[oid]; !ok {
+			logger.Warningf("Object %s is in the journal, but missing from storage", oid)
+		}
+	}
 
-		objectMap[oid] = true
-		expHeap.Push(&ObjectInfo{
-			created: file.ModTime(),
-			oid:     oid,
-		})
+	for oid := range removed {
+		if !lingering[oid] {
+			delete(removed, oid)
+		}
 	}
 
 	return nil
@@ -82,36 +143,128 @@ func indexDataDir(objectMap map[string]bool, expHeap *ExpirationHeap, dataDir *s
 
 type Database struct {
 	lock             *sync.RWMutex
-	objectMap        map[string]bool
+	objectMap        map[string]*ObjectInfo
+	pendingOids      map[string]bool
+	openingPulls     map[string]uint
+	deferredRemovals map[string]bool
+	uploads          map[string]*UploadSession
 	expHeap          *ExpirationHeap
 	heapCleanCond    *sync.Cond
 	dirtyHeapBlocks  uint
 	heapCleanPending bool
-	dataDir          string
-	ttlMin           uint
-	destructiveRead  bool
+	storage          Storage
+	journal          *Journal
+	defaultTTL       time.Duration
+	maxTTL           time.Duration
+	defaultMaxPulls  uint
 }
 
-func (db *Database) pull(oid string) ([]byte, error) {
-	db.lock.RLock()
-	_, ok := db.objectMap[oid]
-	db.lock.RUnlock()
-	if !ok {
+// Pulls are claimed atomically, so once an object runs out of pulls no further requester can read it.
+// The object is opened after the lock is released, and a pull is spent even if the object then fails to open.
+func (db *Database) pull(oid string) (io.ReadCloser, error) {
+	db.lock.Lock()
+
+	// Expired objects are only removed by the next expiry tick, but must not be pulled in the meantime.
+	oi, ok := db.objectMap[oid]
+	if !ok || oi.IsExpired() {
+		db.lock.Unlock()
 		return nil, nil
 	}
 
+	db.openingPulls[oid]++
+
+	limited := oi.maxPulls != unlimitedPulls
+	shouldStartHeapCleaner := false
+	if limited {
+		oi.pullsRemaining--
+		if oi.pullsRemaining == 0 {
+			shouldStartHeapCleaner = db.forgetObject(oid)
+			db.deferRemoval(oid)
+		} else {
+			db.journal.recordPull(oi)
+		}
+	}
+
+	db.lock.Unlock()
+
+	if limited {
+		db.journal.sync()
+	}
+
+	if shouldStartHeapCleaner {
+		go db.heapCleanerJob()
+	}
+
 	data, err := db.readObject(oid)
 
-	if db.destructiveRead {
-		go db.destroyObject(oid)
+	// Removals are deferred while the object is being opened, and the last pull to open it carries them out.
+	db.lock.Lock()
+	db.openingPulls[oid]--
+	remove := false
+	if db.openingPulls[oid] == 0 {
+		delete(db.openingPulls, oid)
+		remove = db.deferredRemovals[oid]
+		delete(db.deferredRemovals, oid)
+	}
+	db.lock.Unlock()
+
+	if remove {
+		db.removeObject(oid)
 	}
 
-	return data, err
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
 }
 
-func (db *Database) drop(bytes []byte) string {
-	const oidLen = 16
-	const maxOidAttempts = 16
+// Returns a snapshot of the metadata of an object, or nil if it does not exist, without claiming a pull.
+func (db *Database) stat(oid string) *ObjectInfo {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	oi, ok := db.objectMap[oid]
+	if !ok {
+		return nil
+	}
+
+	snapshot := *oi
+	return &snapshot
+}
+
+// A ttl of zero selects the default ttl, and any ttl is capped at the maximum ttl.
+// A negative maxPulls selects the default, and zero allows unlimited pulls until the object expires.
+// The oid is only registered once the object has been committed to storage and the journal, and is returned with the
+// effective ttl.
+func (db *Database) drop(
+	data io.Reader,
+	uploader string,
+	ttl time.Duration,
+	maxPulls int,
+) (string, time.Duration, error) {
+	if ttl <= 0 {
+		ttl = db.defaultTTL
+	} else if ttl > db.maxTTL {
+		ttl = db.maxTTL
+	}
+
+	pulls := db.defaultMaxPulls
+	if maxPulls >= 0 {
+		pulls = uint(maxPulls)
+	}
+
+	oid := db.reserveOid()
+
+	size, err := db.storage.write(oid, data)
+	if err != nil {
+		logger.Errorf("Failed to write object %s to storage: %v", oid, err)
+
+		db.lock.Lock()
+		delete(db.pendingOids, oid)
+		db.lock.Unlock()
+
+		return "", 0, err
+	}
 
 	db.lock.Lock()
 
@@ -119,11 +272,59 @@ func (db *Database) drop(bytes []byte) string {
 		db.heapCleanCond.Wait()
 	}
 
+	now := time.Now()
+	oi := &ObjectInfo{
+		created:        now,
+		expires:        now.Add(ttl),
+		size:           size,
+		maxPulls:       pulls,
+		pullsRemaining: pulls,
+		uploader:       uploader,
+		oid:            oid,
+	}
+	delete(db.pendingOids, oid)
+	if err = db.journal.recordPut(oi); err != nil {
+		db.lock.Unlock()
+		db.removeObject(oid)
+		return "", 0, err
+	}
+	db.objectMap[oid] = oi
+	heap.Push(db.expHeap, oi)
+
+	db.lock.Unlock()
+
+	// The oid has not been handed out yet, so nothing can have pulled the object before it is abandoned.
+	if err = db.journal.sync(); err != nil {
+		db.lock.Lock()
+		shouldStartHeapCleaner := db.forgetObject(oid)
+		db.lock.Unlock()
+
+		if shouldStartHeapCleaner {
+			go db.heapCleanerJob()
+		}
+		db.removeObject(oid)
+		return "", 0, err
+	}
+
+	return oid, ttl, nil
+}
+
+// Picks an unused oid, and reserves it until the object being dropped is either committed or abandoned.
+func (db *Database) reserveOid() string {
+	const oidLen = 16
+	const maxOidAttempts = 16
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
 	oid := ""
 	attempt := 1
 	for {
 		oid = db.randomOid(oidLen)
-		if _, ok := db.objectMap[oid]; !ok {
+		_, live := db.objectMap[oid]
+		_, pending := db.pendingOids[oid]
+		_, opening := db.openingPulls[oid]
+		if !live && !pending && !opening {
 			break
 		}
 		attempt++
@@ -133,16 +334,7 @@ func (db *Database) drop(bytes []byte) string {
 		}
 	}
 
-	db.objectMap[oid] = true
-	heap.Push(db.expHeap, &ObjectInfo{
-		created: time.Now(),
-		oid:     oid,
-	})
-
-	db.lock.Unlock()
-
-	db.writeObject(oid, bytes)
-
+	db.pendingOids[oid] = true
 	return oid
 }
 
@@ -158,22 +350,29 @@ func (db *Database) expiryJob() {
 			db.heapCleanCond.Wait()
 		}
 
-		for !db.expHeap.IsEmpty() && db.expHeap.Peek().IsExpired(db.ttlMin) {
+		for !db.expHeap.IsEmpty() && db.expHeap.Peek().IsExpired() {
 			oi := heap.Pop(db.expHeap).(*ObjectInfo)
 
-			if _, ok := db.objectMap[oi.oid]; ok {
+			if current, ok := db.objectMap[oi.oid]; ok && current == oi {
 				delete(db.objectMap, oi.oid)
-				expired = append(expired, oi)
+				db.journal.recordDelete(oi.oid)
+				if !db.deferRemoval(oi.oid) {
+					expired = append(expired, oi)
+				}
 			} else {
 				db.dirtyHeapBlocks -= 1
 			}
 		}
 		db.lock.Unlock()
 
+		db.journal.sync()
+
 		for _, oi := range expired {
 			logger.Infof("Removing expired object %s", oi.oid)
 			db.removeObject(oi.oid)
 		}
+
+		db.expireUploads()
 	}
 }
 
@@ -190,7 +389,7 @@ func (db *Database) heapCleanerJob() {
 	for oldCursor < db.expHeap.Len() {
 		current := (*db.expHeap)[oldCursor]
 
-		if _, ok := db.objectMap[current.oid]; ok {
+		if live, ok := db.objectMap[current.oid]; ok && live == current {
 			newHeap[newCursor] = current
 			newCursor += 1
 		}
@@ -217,28 +416,61 @@ func (db *Database) heapCleanerJob() {
 	logger.Infof("Finished swap to compacted heap")
 }
 
-func (db *Database) destroyObject(oid string) {
-	shouldStartHeapCleaner := false
-
+// Destroys an object before it runs out of pulls or expires, which only the key that dropped it may do.
+func (db *Database) destroyObject(oid string, uploader string) error {
 	db.lock.Lock()
 
+	oi, ok := db.objectMap[oid]
+	if !ok {
+		db.lock.Unlock()
+		return ObjectNotFoundErr
+	}
+	if oi.uploader == "" || oi.uploader != uploader {
+		db.lock.Unlock()
+		return NotOwnerErr
+	}
+
+	shouldStartHeapCleaner := db.forgetObject(oid)
+	deferred := db.deferRemoval(oid)
+	db.lock.Unlock()
+
+	db.journal.sync()
+
+	if shouldStartHeapCleaner {
+		go db.heapCleanerJob()
+	}
+
+	if !deferred {
+		db.removeObject(oid)
+	}
+	return nil
+}
+
+// Defers the removal of an object from storage while pulls are still opening it, so that claimed pulls can be served.
+// Must be called with the write lock held, and returns true if the last of those pulls will remove the object.
+func (db *Database) deferRemoval(oid string) bool {
+	if db.openingPulls[oid] == 0 {
+		return false
+	}
+	db.deferredRemovals[oid] = true
+	return true
+}
+
+// Removes an object from the object map, leaving a dirty block in the expiration heap.
+// Must be called with the write lock held, and returns true if the heap cleaner should be started.
+func (db *Database) forgetObject(oid string) bool {
 	delete(db.objectMap, oid)
+	db.journal.recordDelete(oid)
 	db.dirtyHeapBlocks += 1
 
 	pastNumberThreshold := db.dirtyHeapBlocks > heapCleanThresholdNumber
 	pastPercentageThreshold := float32(db.dirtyHeapBlocks)/float32(db.expHeap.Len()) > heapCleanThresholdPercent
 	if !db.heapCleanPending && pastNumberThreshold && pastPercentageThreshold {
 		db.heapCleanPending = true
-		shouldStartHeapCleaner = true
+		return true
 	}
 
-	db.lock.Unlock()
-
-	if shouldStartHeapCleaner {
-		go db.heapCleanerJob()
-	}
-
-	db.removeObject(oid)
+	return false
 }
 
 func (db *Database) randomOid(length int) string {
@@ -256,37 +488,36 @@ func (db *Database) randomOid(length int) string {
 	return string(bytes)
 }
 
-func (db *Database) writeObject(oid string, data []byte) {
-	if err := ioutil.WriteFile(db.objectPath(oid), data, lib.ObjectPerms); err != nil {
-		logger.Errorf("Failed to write object %s to disk: %v", oid, err)
-	}
-}
-
-func (db *Database) readObject(oid string) ([]byte, error) {
-	data, err := ioutil.ReadFile(db.objectPath(oid))
+// The returned reader remains valid even if the object is removed while it is being read.
+func (db *Database) readObject(oid string) (io.ReadCloser, error) {
+	data, err := db.storage.read(oid)
 	if err != nil {
-		logger.Errorf("Failed to read object %s from disk: %v", oid, err)
+		logger.Errorf("Failed to read object %s from storage: %v", oid, err)
+		return nil, err
 	}
-	return data, err
+	return data, nil
 }
 
 func (db *Database) removeObject(oid string) {
-	if err := os.Remove(db.objectPath(oid)); err != nil {
+	if err := db.storage.remove(oid); err != nil {
 		logger.Errorf("Failed to remove object %s: %v", oid, err)
 	}
 }
 
-func (db *Database) objectPath(oid string) string {
-	return filepath.Join(db.dataDir, oid)
-}
+const unlimitedPulls = 0
 
 type ObjectInfo struct {
-	created time.Time
-	oid     string
+	created        time.Time
+	expires        time.Time
+	size           int64
+	maxPulls       uint
+	pullsRemaining uint
+	uploader       string
+	oid            string
 }
 
-func (oi *ObjectInfo) IsExpired(ttlMin uint) bool {
-	return oi.created.Add(time.Duration(ttlMin) * time.Minute).Before(time.Now())
+func (oi *ObjectInfo) IsExpired() bool {
+	return oi.expires.Before(time.Now())
 }
 
 type ExpirationHeap []*ObjectInfo
@@ -304,7 +535,7 @@ func (ttlQ ExpirationHeap) Len() int {
 }
 
 func (ttlQ ExpirationHeap) Less(i, j int) bool {
-	return ttlQ[i].created.Before(ttlQ[j].created)
+	return ttlQ[i].expires.Before(ttlQ[j].expires)
 }
 
 func (ttlQ ExpirationHeap) Swap(i, j int) {
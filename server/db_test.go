@@ -1,23 +1,585 @@
 package main
 
 import (
+	"bytes"
+	"container/heap"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
+func newTestDatabase(t *testing.T, maxPulls uint) (*Database, func()) {
+	dataDir, err := ioutil.TempDir("", "dead-drop-db")
+	if err != nil {
+		t.Fatalf("Failed to create data directory: %v", err)
+	}
+
+	db := initDatabase(dataDir, &FileStorage{dataDir: dataDir}, 1, 2, maxPulls)
+	return db, func() {
+		_ = os.RemoveAll(dataDir)
+	}
+}
+
+func objectInfo(db *Database, oid string) *ObjectInfo {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.objectMap[oid]
+}
+
+func pullAll(t *testing.T, db *Database, oid string) []byte {
+	data, err := pullObject(db, oid)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return data
+}
+
+// Pulls an object without failing the test, for goroutines other than the test's own.
+func pullObject(db *Database, oid string) ([]byte, error) {
+	reader, err := db.pull(oid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull object %s: %v", oid, err)
+	}
+	if reader == nil {
+		return nil, nil
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object %s: %v", oid, err)
+	}
+	return data, nil
+}
+
 func TestSimpleDropPull(t *testing.T) {
-	// TODO(shane)
+	db, cleanup := newTestDatabase(t, unlimitedPulls)
+	defer cleanup()
+
+	data := make([]byte, 8<<20)
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		t.Fatalf("Failed to generate object: %v", err)
+	}
+
+	oid, _, err := db.drop(bytes.NewReader(data), "test", 0, -1)
+	if err != nil {
+		t.Fatalf("Failed to drop object: %v", err)
+	}
+
+	if pulled := pullAll(t, db, oid); !bytes.Equal(pulled, data) {
+		t.Fatalf("Pulled object does not match dropped object")
+	}
+	if pulled := pullAll(t, db, "missing"); pulled != nil {
+		t.Fatalf("Expected missing object to not be found")
+	}
+}
+
+type failingReader struct {
+	remaining int
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	if fr.remaining == 0 {
+		return 0, fmt.Errorf("connection reset")
+	}
+	if len(p) > fr.remaining {
+		p = p[:fr.remaining]
+	}
+	fr.remaining -= len(p)
+	return len(p), nil
+}
+
+func TestFailedDrop(t *testing.T) {
+	db, cleanup := newTestDatabase(t, 1)
+	defer cleanup()
+
+	dataDir := db.storage.(*FileStorage).dataDir
+	orphan := filepath.Join(dataDir, tempFilePrefix+"orphan")
+	if err := ioutil.WriteFile(orphan, []byte("partial"), 0660); err != nil {
+		t.Fatalf("Failed to write orphaned temp file: %v", err)
+	}
+
+	oid, _, err := db.drop(&failingReader{remaining: 100000}, "test", 0, -1)
+	if err == nil || oid != "" {
+		t.Fatalf("Expected drop to fail, got oid %s", oid)
+	}
+
+	db.lock.RLock()
+	live, pending := len(db.objectMap), len(db.pendingOids)
+	db.lock.RUnlock()
+	if live != 0 || pending != 0 {
+		t.Fatalf("Expected no registered objects, got %d live and %d pending", live, pending)
+	}
+
+	removeTempFiles(dataDir)
+
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		t.Fatalf("Failed to list data directory: %v", err)
+	}
+	for _, file := range files {
+		if file.Name() != journalName {
+			t.Fatalf("Expected failed drop to leave no files behind, found %s", file.Name())
+		}
+	}
+}
+
+func TestDropFailsWithoutJournal(t *testing.T) {
+	db, cleanup := newTestDatabase(t, 1)
+	defer cleanup()
+
+	// Writes to a closed journal fail, as they would if its disk failed.
+	if err := db.journal.file.Close(); err != nil {
+		t.Fatalf("Failed to close journal: %v", err)
+	}
+
+	oid, _, err := db.drop(bytes.NewReader([]byte("unrecorded")), "test", 0, -1)
+	if err == nil || oid != "" {
+		t.Fatalf("Expected drop to fail, got oid %s", oid)
+	}
+
+	db.lock.RLock()
+	live, pending, expiring := len(db.objectMap), len(db.pendingOids), db.expHeap.Len()
+	db.lock.RUnlock()
+	if live != 0 || pending != 0 || expiring != 0 {
+		t.Fatalf("Expected no registered objects, got %d live, %d pending and %d expiring", live, pending, expiring)
+	}
+
+	stored, err := db.storage.list()
+	if err != nil || len(stored) != 0 {
+		t.Fatalf("Expected the object to be removed from storage, got %v (%v)", stored, err)
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+	db, cleanup := newTestDatabase(t, 1)
+	defer cleanup()
+
+	chunks := [][]byte{[]byte("dead "), []byte("drop "), []byte("resumed")}
+	sid := db.createUpload("test", 30*time.Second, 2)
+
+	if _, err := db.uploadStatus(sid, "intruder"); err != UploadNotFoundErr {
+		t.Fatalf("Expected sessions to be private to their uploader, got %v", err)
+	}
+	if err := db.uploadChunk(sid, "test", 1, bytes.NewReader(chunks[1])); err != UploadConflictErr {
+		t.Fatalf("Expected out of order chunk to conflict, got %v", err)
+	}
+
+	if err := db.uploadChunk(sid, "test", 0, bytes.NewReader(chunks[0])); err != nil {
+		t.Fatalf("Failed to upload chunk 0: %v", err)
+	}
+	if err := db.uploadChunk(sid, "test", 1, &failingReader{remaining: 2}); err == nil {
+		t.Fatalf("Expected interrupted chunk to fail")
+	}
+
+	status, err := db.uploadStatus(sid, "test")
+	if err != nil || status.Chunks != 1 || status.Offset != int64(len(chunks[0])) {
+		t.Fatalf("Expected 1 chunk to be received, got %+v: %v", status, err)
+	}
+
+	// Resending a received chunk is harmless.
+	for i, chunk := range chunks {
+		if err := db.uploadChunk(sid, "test", uint64(i), bytes.NewReader(chunk)); err != nil {
+			t.Fatalf("Failed to upload chunk %d: %v", i, err)
+		}
+	}
+
+	oid, ttl, err := db.finalizeUpload(sid, "test")
+	if err != nil || ttl != 30*time.Second {
+		t.Fatalf("Failed to finalize upload with ttl %v: %v", ttl, err)
+	}
+	if again, _, err := db.finalizeUpload(sid, "test"); err != nil || again != oid {
+		t.Fatalf("Expected finalizing again to return %s, got %s: %v", oid, again, err)
+	}
+
+	if oi := objectInfo(db, oid); oi == nil || oi.maxPulls != 2 || oi.uploader != "test" {
+		t.Fatalf("Expected %s to be dropped with 2 pulls by test", oid)
+	}
+	if pulled := pullAll(t, db, oid); string(pulled) != "dead drop resumed" {
+		t.Fatalf("Pulled object does not match uploaded chunks: %s", pulled)
+	}
+
+	abandoned := db.createUpload("test", 0, -1)
+	if err := db.uploadChunk(abandoned, "test", 0, bytes.NewReader(chunks[0])); err != nil {
+		t.Fatalf("Failed to upload chunk 0: %v", err)
+	}
+
+	db.lock.Lock()
+	for _, session := range db.uploads {
+		session.expires = time.Now().Add(-time.Second)
+	}
+	db.lock.Unlock()
+	db.expireUploads()
+
+	if _, err := db.uploadStatus(abandoned, "test"); err != UploadNotFoundErr {
+		t.Fatalf("Expected abandoned upload to expire, got %v", err)
+	}
+
+	files, err := ioutil.ReadDir(db.storage.(*FileStorage).dataDir)
+	if err != nil {
+		t.Fatalf("Failed to list data directory: %v", err)
+	}
+	for _, file := range files {
+		if file.Name() != journalName && file.Name() != oid {
+			t.Fatalf("Expected uploads to leave no chunks behind, found %s", file.Name())
+		}
+	}
 }
 
 func TestIndexExistingObjects(t *testing.T) {
-	// TODO(shane)
+	db, cleanup := newTestDatabase(t, 1)
+	defer cleanup()
+
+	data := []byte("survives restarts")
+	limitedOid, _, _ := db.drop(bytes.NewReader(data), "test", 30*time.Second, 3)
+	pullAll(t, db, limitedOid)
+	unlimitedOid, _, _ := db.drop(bytes.NewReader(data), "test", 0, unlimitedPulls)
+	pulledOid, _, _ := db.drop(bytes.NewReader(data), "test", 0, -1)
+	pullAll(t, db, pulledOid)
+	removedOid, _, _ := db.drop(bytes.NewReader(data), "test", 0, -1)
+
+	limited := *objectInfo(db, limitedOid)
+
+	// Touching an object must not reset its expiry.
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(db.storage.(*FileStorage).objectPath(limitedOid), future, future); err != nil {
+		t.Fatalf("Failed to touch object: %v", err)
+	}
+	if err := os.Remove(db.storage.(*FileStorage).objectPath(removedOid)); err != nil {
+		t.Fatalf("Failed to remove object: %v", err)
+	}
+	if err := ioutil.WriteFile(db.storage.(*FileStorage).objectPath("orphan"), data, 0660); err != nil {
+		t.Fatalf("Failed to write orphan object: %v", err)
+	}
+	// An object whose removal failed after its last pull must not be resurrected.
+	if err := ioutil.WriteFile(db.storage.(*FileStorage).objectPath(pulledOid), data, 0660); err != nil {
+		t.Fatalf("Failed to write pulled object: %v", err)
+	}
+
+	dataDir := db.storage.(*FileStorage).dataDir
+	restarted := initDatabase(dataDir, &FileStorage{dataDir: dataDir}, 1, 2, 1)
+
+	oi := objectInfo(restarted, limitedOid)
+	if oi == nil {
+		t.Fatalf("Expected %s to be indexed", limitedOid)
+	}
+	if !oi.expires.Equal(limited.expires) || !oi.created.Equal(limited.created) {
+		t.Fatalf("Expected expiry %v, got %v", limited.expires, oi.expires)
+	}
+	if oi.pullsRemaining != 2 || oi.maxPulls != 3 {
+		t.Fatalf("Expected 2 of 3 pulls remaining, got %d of %d", oi.pullsRemaining, oi.maxPulls)
+	}
+	if oi.size != int64(len(data)) || oi.uploader != "test" {
+		t.Fatalf("Expected size %d from test, got %d from %s", len(data), oi.size, oi.uploader)
+	}
+
+	if oi := objectInfo(restarted, unlimitedOid); oi == nil || oi.maxPulls != unlimitedPulls {
+		t.Fatalf("Expected %s to be indexed with unlimited pulls", unlimitedOid)
+	}
+	if oi := objectInfo(restarted, pulledOid); oi != nil {
+		t.Fatalf("Expected %s to stay destroyed", pulledOid)
+	}
+	if _, err := os.Stat(db.storage.(*FileStorage).objectPath(pulledOid)); !os.IsNotExist(err) {
+		t.Fatalf("Expected %s to be removed from storage", pulledOid)
+	}
+	if oi := objectInfo(restarted, removedOid); oi != nil {
+		t.Fatalf("Expected %s to be dropped from the index", removedOid)
+	}
+	if oi := objectInfo(restarted, "orphan"); oi == nil || oi.pullsRemaining != 1 {
+		t.Fatalf("Expected orphan to be indexed with default metadata")
+	}
+	if oi := objectInfo(restarted, journalName); oi != nil {
+		t.Fatalf("Expected the journal to not be indexed")
+	}
+}
+
+func TestMemoryDatabase(t *testing.T) {
+	parentDir, err := ioutil.TempDir("", "dead-drop-db")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(parentDir)
+
+	dataDir := filepath.Join(parentDir, "data")
+	db := initDatabase(dataDir, newMemoryStorage(), 1, 2, 2)
+
+	data := []byte("never touches a disk")
+	oid, _, err := db.drop(bytes.NewReader(data), "test", 0, -1)
+	if err != nil {
+		t.Fatalf("Failed to drop object: %v", err)
+	}
+	if pulled := pullAll(t, db, oid); !bytes.Equal(pulled, data) {
+		t.Fatalf("Pulled object does not match dropped object")
+	}
+
+	if _, err := os.Stat(dataDir); !os.IsNotExist(err) {
+		t.Fatalf("Expected the data directory to not be created, got %v", err)
+	}
 }
 
 func TestObjectExpiration(t *testing.T) {
-	// TODO(shane)
+	db, cleanup := newTestDatabase(t, unlimitedPulls)
+	defer cleanup()
+
+	longOid, longTTL, _ := db.drop(bytes.NewReader([]byte("long")), "test", time.Hour, -1)
+	if longTTL != 2*time.Minute {
+		t.Fatalf("Expected ttl to be capped at 2m, got %v", longTTL)
+	}
+
+	shortOid, shortTTL, _ := db.drop(bytes.NewReader([]byte("short")), "test", 30*time.Second, -1)
+	if shortTTL != 30*time.Second {
+		t.Fatalf("Expected ttl of 30s, got %v", shortTTL)
+	}
+
+	_, defaultTTL, _ := db.drop(bytes.NewReader([]byte("default")), "test", 0, -1)
+	if defaultTTL != time.Minute {
+		t.Fatalf("Expected default ttl of 1m, got %v", defaultTTL)
+	}
+
+	// Popping modifies the heap, so it needs the write lock.
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	expected := []string{shortOid, "", longOid}
+	for _, oid := range expected {
+		oi := heap.Pop(db.expHeap).(*ObjectInfo)
+		if oid != "" && oi.oid != oid {
+			t.Fatalf("Expected %s to expire before %s", oid, oi.oid)
+		}
+		if oi.IsExpired() {
+			t.Fatalf("Object %s expired early", oi.oid)
+		}
+	}
+}
+
+func TestExpiredPull(t *testing.T) {
+	db, cleanup := newTestDatabase(t, 2)
+	defer cleanup()
+
+	oid, _, err := db.drop(bytes.NewReader([]byte("too late")), "test", 0, -1)
+	if err != nil {
+		t.Fatalf("Failed to drop object: %v", err)
+	}
+
+	// The object has expired, but the expiry job has not removed it yet.
+	db.lock.Lock()
+	db.objectMap[oid].expires = time.Now().Add(-time.Second)
+	db.lock.Unlock()
+
+	if pulled := pullAll(t, db, oid); pulled != nil {
+		t.Fatalf("Expected expired object %s to not be found", oid)
+	}
+	if oi := objectInfo(db, oid); oi == nil || oi.pullsRemaining != 2 {
+		t.Fatalf("Expected a pull of an expired object to not be claimed")
+	}
 }
 
 func TestDestructiveRead(t *testing.T) {
-	// TODO(shane)
+	db, cleanup := newTestDatabase(t, 1)
+	defer cleanup()
+
+	data := []byte("burn after reading")
+	defaultOid, _, _ := db.drop(bytes.NewReader(data), "test", 0, -1)
+	limitedOid, _, _ := db.drop(bytes.NewReader(data), "test", 0, 3)
+	unlimitedOid, _, _ := db.drop(bytes.NewReader(data), "test", 0, unlimitedPulls)
+
+	expectedPulls := map[string]int{
+		defaultOid:   1,
+		limitedOid:   3,
+		unlimitedOid: 10,
+	}
+	for oid, pulls := range expectedPulls {
+		for i := 0; i < pulls; i++ {
+			if pulled := pullAll(t, db, oid); !bytes.Equal(pulled, data) {
+				t.Fatalf("Expected pull %d of %s to succeed", i+1, oid)
+			}
+		}
+	}
+
+	for _, oid := range []string{defaultOid, limitedOid} {
+		if pulled := pullAll(t, db, oid); pulled != nil {
+			t.Fatalf("Expected %s to be destroyed after its last pull", oid)
+		}
+	}
+}
+
+func TestObjectStatus(t *testing.T) {
+	db, cleanup := newTestDatabase(t, 1)
+	defer cleanup()
+
+	data := []byte("still waiting")
+	oid, _, _ := db.drop(bytes.NewReader(data), "test", 0, 2)
+
+	// Checking the status of an object must not consume a pull.
+	for i := 0; i < 3; i++ {
+		oi := db.stat(oid)
+		if oi == nil || oi.size != int64(len(data)) || oi.pullsRemaining != 2 {
+			t.Fatalf("Expected %s to have 2 pulls remaining", oid)
+		}
+	}
+
+	pullAll(t, db, oid)
+	if oi := db.stat(oid); oi == nil || oi.pullsRemaining != 1 {
+		t.Fatalf("Expected %s to have 1 pull remaining", oid)
+	}
+
+	pullAll(t, db, oid)
+	if oi := db.stat(oid); oi != nil {
+		t.Fatalf("Expected %s to be gone after its last pull", oid)
+	}
+}
+
+func TestRevokeObject(t *testing.T) {
+	db, cleanup := newTestDatabase(t, 1)
+	defer cleanup()
+
+	oid, _, _ := db.drop(bytes.NewReader([]byte("wrong recipient")), "sender", 0, -1)
+
+	if err := db.destroyObject(oid, "recipient"); err != NotOwnerErr {
+		t.Fatalf("Expected revoking another key's object to fail, got %v", err)
+	}
+	if oi := db.stat(oid); oi == nil {
+		t.Fatalf("Expected %s to survive a failed revoke", oid)
+	}
+
+	if err := db.destroyObject(oid, "sender"); err != nil {
+		t.Fatalf("Failed to revoke %s: %v", oid, err)
+	}
+	if pulled := pullAll(t, db, oid); pulled != nil {
+		t.Fatalf("Expected %s to be destroyed", oid)
+	}
+	if _, err := db.storage.read(oid); err != ObjectNotFoundErr {
+		t.Fatalf("Expected %s to be removed from storage, got %v", oid, err)
+	}
+	if err := db.destroyObject(oid, "sender"); err != ObjectNotFoundErr {
+		t.Fatalf("Expected revoking a destroyed object to fail, got %v", err)
+	}
+
+	// Objects indexed without a journal entry have no known owner.
+	orphanOid, _, _ := db.drop(bytes.NewReader([]byte("orphan")), "", 0, -1)
+	if err := db.destroyObject(orphanOid, ""); err != NotOwnerErr {
+		t.Fatalf("Expected revoking an unowned object to fail, got %v", err)
+	}
+}
+
+func TestConcurrentDestructivePulls(t *testing.T) {
+	const pullers = 64
+
+	db, cleanup := newTestDatabase(t, 1)
+	defer cleanup()
+
+	data := []byte("burn after reading")
+
+	for _, maxPulls := range []int{1, 3} {
+		oid, _, _ := db.drop(bytes.NewReader(data), "test", 0, maxPulls)
+
+		start := make(chan struct{})
+		results := make(chan error, pullers)
+		claims := make(chan bool, pullers)
+
+		for i := 0; i < pullers; i++ {
+			go func() {
+				<-start
+
+				reader, err := db.pull(oid)
+				if err != nil || reader == nil {
+					results <- err
+					claims <- false
+					return
+				}
+				defer reader.Close()
+
+				pulled, err := ioutil.ReadAll(reader)
+				if err == nil && !bytes.Equal(pulled, data) {
+					err = fmt.Errorf("pulled object does not match dropped object")
+				}
+				results <- err
+				claims <- err == nil
+			}()
+		}
+
+		close(start)
+
+		claimed := 0
+		for i := 0; i < pullers; i++ {
+			if err := <-results; err != nil {
+				t.Fatalf("Failed to pull object %s: %v", oid, err)
+			}
+			if <-claims {
+				claimed++
+			}
+		}
+
+		if claimed != maxPulls {
+			t.Fatalf("Expected exactly %d pulls of %s to succeed, got %d", maxPulls, oid, claimed)
+		}
+	}
+}
+
+// slowStorage holds up reads until they are released, like a slow s3 request.
+type slowStorage struct {
+	Storage
+	opening chan struct{}
+	release chan struct{}
+}
+
+func (ss *slowStorage) read(oid string) (io.ReadCloser, error) {
+	ss.opening <- struct{}{}
+	<-ss.release
+	return ss.Storage.read(oid)
+}
+
+func TestPullOpensOutsideLock(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "dead-drop-db")
+	if err != nil {
+		t.Fatalf("Failed to create data directory: %v", err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	files := &FileStorage{dataDir: dataDir}
+	storage := &slowStorage{Storage: files, opening: make(chan struct{}), release: make(chan struct{})}
+	db := initDatabase(dataDir, storage, 1, 2, 1)
+
+	data := []byte("slow to open")
+	oid, _, err := db.drop(bytes.NewReader(data), "sender", 0, 2)
+	if err != nil {
+		t.Fatalf("Failed to drop object: %v", err)
+	}
+
+	pulled := make(chan []byte, 1)
+	pullErr := make(chan error, 1)
+	go func() {
+		data, err := pullObject(db, oid)
+		pulled <- data
+		pullErr <- err
+	}()
+	<-storage.opening
+
+	// Destroying the object needs the lock, and must leave it in storage until the claimed pull has opened it.
+	if err := db.destroyObject(oid, "sender"); err != nil {
+		t.Fatalf("Failed to destroy object while it was being opened: %v", err)
+	}
+	if _, err := os.Stat(files.objectPath(oid)); err != nil {
+		t.Fatalf("Expected %s to stay in storage while it is being opened: %v", oid, err)
+	}
+
+	close(storage.release)
+	read := <-pulled
+	if err := <-pullErr; err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatalf("Pulled object does not match dropped object")
+	}
+	if _, err := os.Stat(files.objectPath(oid)); !os.IsNotExist(err) {
+		t.Fatalf("Expected %s to be removed once it was opened, got %v", oid, err)
+	}
 }
 
 func TestHeapCleanerWithConcurrentPulls(t *testing.T) {
@@ -47,4 +609,3 @@ func TestConcurrentReadAndRemoval(t *testing.T) {
 func TestStaleObjectMap(t *testing.T) {
 	// TODO(shane)
 }
-
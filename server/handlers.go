@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"dead-drop/lib"
 	"encoding/json"
+	"errors"
 	"github.com/google/logger"
 	"github.com/gorilla/mux"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"regexp"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 type Handler struct {
@@ -16,8 +22,14 @@ type Handler struct {
 	auth *Authenticator
 }
 
+type contextKey string
+
+const keyNameContextKey = contextKey("keyName")
+
 var keyNameRegex = regexp.MustCompile(lib.KeyNameRegex)
 
+const maxAddKeyPayloadSize = 64 * 1024
+
 func (handler *Handler) handlePull(w http.ResponseWriter, req *http.Request) {
 	params := mux.Vars(req)
 	oid := params["oid"]
@@ -30,26 +42,110 @@ func (handler *Handler) handlePull(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	defer data.Close()
 
-	_, err = w.Write(data)
-	if err != nil {
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	// Once the first bytes are written the status is committed, so a failed copy can only be logged.
+	if _, err = io.Copy(w, data); err != nil {
 		logger.Errorf("Failed to write object response: %v", err)
+		return
+	}
+}
+
+// Reports the size, remaining ttl, and remaining pulls of an object through headers, without consuming it.
+func (handler *Handler) handleStatus(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	oid := params["oid"]
+
+	oi := handler.db.stat(oid)
+	if oi == nil || oi.IsExpired() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	ttl := time.Until(oi.expires)
+
+	w.Header().Set("Content-Length", strconv.FormatInt(oi.size, 10))
+	w.Header().Set(lib.TTLHeader, strconv.FormatInt(int64(ttl/time.Second), 10))
+	w.Header().Set(lib.MaxPullsHeader, strconv.FormatUint(uint64(oi.maxPulls), 10))
+	if oi.maxPulls != unlimitedPulls {
+		w.Header().Set(lib.PullsRemainingHeader, strconv.FormatUint(uint64(oi.pullsRemaining), 10))
+	}
+}
+
+func (handler *Handler) handleRevoke(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	oid := params["oid"]
+
+	keyName, _ := req.Context().Value(keyNameContextKey).(string)
+
+	err := handler.db.destroyObject(oid, keyName)
+	if err == ObjectNotFoundErr {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err == NotOwnerErr {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	} else if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+
+	logger.Infof("Object %s revoked by %s", oid, keyName)
 }
 
 func (handler *Handler) handleDrop(w http.ResponseWriter, req *http.Request) {
-	bytes, err := ioutil.ReadAll(req.Body)
+	ttl, maxPulls, err := parseDropOptions(req)
 	if err != nil {
-		logger.Errorf("Failed to read object body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	keyName, _ := req.Context().Value(keyNameContextKey).(string)
+
+	oid, ttl, err := handler.db.drop(req.Body, keyName, ttl, maxPulls)
+	if err == BodyMismatchErr {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if isInsufficientStorage(err) {
+		w.WriteHeader(http.StatusInsufficientStorage)
+		return
+	} else if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	oid := handler.db.drop(bytes)
+	writeDropResponse(w, oid, ttl)
+}
+
+// Parses the requested ttl and pull limit of a drop, which are zero and -1 respectively when not specified.
+func parseDropOptions(req *http.Request) (time.Duration, int, error) {
+	var ttl time.Duration
+	if rawTTL := req.Header.Get(lib.TTLHeader); rawTTL != "" {
+		ttlSec, err := strconv.ParseUint(rawTTL, 10, 32)
+		if err != nil {
+			return 0, 0, err
+		}
+		ttl = time.Duration(ttlSec) * time.Second
+	}
+
+	maxPulls := -1
+	if rawMaxPulls := req.Header.Get(lib.MaxPullsHeader); rawMaxPulls != "" {
+		pulls, err := strconv.ParseUint(rawMaxPulls, 10, 31)
+		if err != nil {
+			return 0, 0, err
+		}
+		maxPulls = int(pulls)
+	}
 
-	_, err = io.WriteString(w, oid)
+	return ttl, maxPulls, nil
+}
+
+func writeDropResponse(w http.ResponseWriter, oid string, ttl time.Duration) {
+	w.Header().Set(lib.TTLHeader, strconv.FormatInt(int64(ttl/time.Second), 10))
+
+	_, err := io.WriteString(w, oid)
 	if err != nil {
 		logger.Errorf("Failed to write object response: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -57,74 +153,167 @@ func (handler *Handler) handleDrop(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (handler *Handler) handleAddKey(w http.ResponseWriter, req *http.Request) {
-	var payload lib.AddKeyPayload
-	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
-		logger.Errorf("Failed to decode payload: %v", err)
+func (handler *Handler) handleCreateUpload(w http.ResponseWriter, req *http.Request) {
+	ttl, maxPulls, err := parseDropOptions(req)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	if !keyNameRegex.Match([]byte(payload.KeyName)) {
+	keyName, _ := req.Context().Value(keyNameContextKey).(string)
+
+	sid := handler.db.createUpload(keyName, ttl, maxPulls)
+
+	if _, err = io.WriteString(w, sid); err != nil {
+		logger.Errorf("Failed to write upload response: %v", err)
+	}
+}
+
+func (handler *Handler) handleUploadStatus(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	keyName, _ := req.Context().Value(keyNameContextKey).(string)
+
+	status, err := handler.db.uploadStatus(params["sid"], keyName)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(status); err != nil {
+		logger.Errorf("Failed to write upload status response: %v", err)
+	}
+}
+
+func (handler *Handler) handleUploadChunk(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	keyName, _ := req.Context().Value(keyNameContextKey).(string)
+
+	index, err := strconv.ParseUint(params["chunk"], 10, 64)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if req.ContentLength > maxUploadChunkSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
 
-	logger.Infof("Adding public key %s", payload.KeyName)
+	body := http.MaxBytesReader(w, req.Body, maxUploadChunkSize)
+	if err = handler.db.uploadChunk(params["sid"], keyName, index, body); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+}
 
-	if err := handler.auth.addAuthorizedKey(payload.Key, payload.KeyName); err != nil {
-		logger.Errorf("Failed to add authorized key: %v", err)
+func (handler *Handler) handleFinalizeUpload(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	keyName, _ := req.Context().Value(keyNameContextKey).(string)
+
+	oid, ttl, err := handler.db.finalizeUpload(params["sid"], keyName)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	writeDropResponse(w, oid, ttl)
+}
+
+func writeUploadError(w http.ResponseWriter, err error) {
+	// Chunks sent without a length are only found to be too large once the limit is read past.
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == UploadNotFoundErr:
+		w.WriteHeader(http.StatusNotFound)
+	case err == UploadConflictErr:
+		w.WriteHeader(http.StatusConflict)
+	case err == BodyMismatchErr:
+		w.WriteHeader(http.StatusBadRequest)
+	case errors.As(err, &tooLarge):
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	case isInsufficientStorage(err):
+		w.WriteHeader(http.StatusInsufficientStorage)
+	default:
 		w.WriteHeader(http.StatusInternalServerError)
 	}
 }
 
-func (handler *Handler) handleToken(w http.ResponseWriter, req *http.Request) {
-	var payload lib.TokenRequestPayload
-	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
-		logger.Errorf("Failed to decode authentication payload: %v", err)
+func isInsufficientStorage(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	return err == syscall.ENOSPC || err == syscall.EDQUOT
+}
+
+func (handler *Handler) handleAddKey(w http.ResponseWriter, req *http.Request) {
+	// The body is read to EOF before it is decoded, so that it is checked against its signed hash.
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxAddKeyPayloadSize))
+	if err != nil {
+		logger.Errorf("Failed to read payload: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	if !keyNameRegex.Match([]byte(payload.KeyName)) {
+	var payload lib.AddKeyPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		logger.Errorf("Failed to decode payload: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	storedKey, err := handler.auth.getAuthorizedKey(payload.KeyName)
-	if err != nil {
-		logger.Errorf("Failed to load authorized key: %v", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	if !keyNameRegex.Match([]byte(payload.KeyName)) {
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	token, err := handler.auth.generateToken(storedKey)
-	if err == UnauthorizedErr {
-		w.WriteHeader(http.StatusUnauthorized)
+	if _, err := lib.ParsePublicKey(payload.Key); err != nil {
+		logger.Errorf("Rejected public key %s: %v", payload.KeyName, err)
+		w.WriteHeader(http.StatusBadRequest)
 		return
-	} else if err != nil {
-		logger.Errorf("Failed to generate authorization token: %v", err)
+	}
+
+	logger.Infof("Adding public key %s", payload.KeyName)
+
+	if err := handler.auth.addAuthorizedKey(payload.Key, payload.KeyName); err != nil {
+		logger.Errorf("Failed to add authorized key: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
-		return
 	}
+}
 
-	_, err = io.WriteString(w, token)
+func (handler *Handler) handleChallenge(w http.ResponseWriter, req *http.Request) {
+	challenge, err := handler.auth.generateChallenge()
 	if err != nil {
-		logger.Errorf("Failed to write authorization token response: %v", err)
+		logger.Errorf("Failed to generate challenge: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+
+	if _, err = io.WriteString(w, challenge); err != nil {
+		logger.Errorf("Failed to write challenge response: %v", err)
+	}
 }
 
+// Requests must be signed (see verifyRequest).
 func (handler *Handler) authenticate(h http.HandlerFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		token := req.Header.Get("Authorization")
+		// The nonce for the client's next request, which spares it a round trip.
+		if nonce, err := handler.auth.generateChallenge(); err != nil {
+			logger.Errorf("Failed to generate nonce: %v", err)
+		} else {
+			w.Header().Set(lib.NonceHeader, nonce)
+		}
 
-		if !handler.auth.validateToken(token) {
+		keyName, ok := handler.auth.verifyRequest(req)
+		if !ok {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		h.ServeHTTP(w, req)
+		h.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), keyNameContextKey, keyName)))
 	})
 }
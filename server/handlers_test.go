@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestUploadChunkTooLarge(t *testing.T) {
+	db := initDatabase("", newMemoryStorage(), 1, 2, 1)
+	handler := &Handler{db: db}
+	sid := db.createUpload("test", 0, -1)
+
+	uploadChunk := func(contentLength int64) int {
+		body := io.LimitReader(zeroReader{}, maxUploadChunkSize+1)
+		req := httptest.NewRequest("PUT", "/u/"+sid+"/0", body)
+		req.ContentLength = contentLength
+		req = mux.SetURLVars(req, map[string]string{"sid": sid, "chunk": "0"})
+		req = req.WithContext(context.WithValue(req.Context(), keyNameContextKey, "test"))
+
+		recorder := httptest.NewRecorder()
+		handler.handleUploadChunk(recorder, req)
+		return recorder.Code
+	}
+
+	// Chunks are rejected up front when their length is known, and once the limit is read past when it is not.
+	for _, contentLength := range []int64{maxUploadChunkSize + 1, -1} {
+		if code := uploadChunk(contentLength); code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("Expected oversized chunk with length %d to be rejected with 413, got %d", contentLength, code)
+		}
+	}
+
+	status, err := db.uploadStatus(sid, "test")
+	if err != nil || status.Chunks != 0 {
+		t.Fatalf("Expected no chunks to be stored, got %v (%v)", status, err)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"dead-drop/lib"
+	"encoding/json"
+	"github.com/google/logger"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The journal lives in the data directory, and is hidden so that it is never mistaken for an object.
+const journalName = ".journal"
+
+const journalOpPut = "put"
+const journalOpPull = "pull"
+const journalOpDelete = "del"
+
+// The journal is an append-only log of object metadata, which is replayed and compacted on startup.
+// A journal without a file records nothing, for storage that does not survive restarts.
+type Journal struct {
+	file *os.File
+	// The length of the complete entries in the file, which a failed append is truncated back to.
+	size int64
+}
+
+type journalEntry struct {
+	Op             string `json:"op"`
+	Oid            string `json:"oid"`
+	Created        int64  `json:"created,omitempty"`
+	Expires        int64  `json:"expires,omitempty"`
+	Size           int64  `json:"size,omitempty"`
+	MaxPulls       uint   `json:"maxPulls,omitempty"`
+	PullsRemaining uint   `json:"pullsRemaining,omitempty"`
+	Uploader       string `json:"uploader,omitempty"`
+}
+
+func isHiddenFile(name string) bool {
+	return len(name) > 0 && name[0] == '.'
+}
+
+// Replays the journal in the data directory, returning the last known metadata of each object,
+// along with tombstones for removed objects that may still linger in storage.
+func replayJournal(dataDir string) (map[string]*ObjectInfo, map[string]bool, error) {
+	objects := make(map[string]*ObjectInfo)
+	removed := make(map[string]bool)
+
+	file, err := os.Open(filepath.Join(dataDir, journalName))
+	if os.IsNotExist(err) {
+		return objects, removed, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for {
+		var entry journalEntry
+		if err := decoder.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			// A crash can leave a partially written entry at the end of the journal.
+			logger.Warningf("Stopped replaying journal at a corrupt entry: %v", err)
+			break
+		}
+
+		switch entry.Op {
+		case journalOpPut:
+			delete(removed, entry.Oid)
+			objects[entry.Oid] = &ObjectInfo{
+				created:        time.Unix(0, entry.Created),
+				expires:        time.Unix(0, entry.Expires),
+				size:           entry.Size,
+				maxPulls:       entry.MaxPulls,
+				pullsRemaining: entry.PullsRemaining,
+				uploader:       entry.Uploader,
+				oid:            entry.Oid,
+			}
+		case journalOpPull:
+			if oi, ok := objects[entry.Oid]; ok {
+				oi.pullsRemaining = entry.PullsRemaining
+			}
+		case journalOpDelete:
+			delete(objects, entry.Oid)
+			removed[entry.Oid] = true
+		default:
+			logger.Warningf("Skipping journal entry with unknown op %s", entry.Op)
+		}
+	}
+
+	return objects, removed, nil
+}
+
+// Rewrites the journal to contain only the given objects and tombstones, and opens it for appending.
+func openJournal(dataDir string, objects map[string]*ObjectInfo, removed map[string]bool) (*Journal, error) {
+	path := filepath.Join(dataDir, journalName)
+	tempPath := path + ".tmp"
+
+	tempFile, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, lib.ObjectPerms)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := bufio.NewWriter(tempFile)
+	encoder := json.NewEncoder(writer)
+	for _, oi := range objects {
+		if err := encoder.Encode(putEntry(oi)); err != nil {
+			tempFile.Close()
+			return nil, err
+		}
+	}
+	for oid := range removed {
+		if err := encoder.Encode(deleteEntry(oid)); err != nil {
+			tempFile.Close()
+			return nil, err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		tempFile.Close()
+		return nil, err
+	}
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return nil, err
+	}
+	if err := tempFile.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return nil, err
+	}
+	if err := syncDir(dataDir); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, lib.ObjectPerms)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &Journal{file: file, size: info.Size()}, nil
+}
+
+func putEntry(oi *ObjectInfo) *journalEntry {
+	return &journalEntry{
+		Op:             journalOpPut,
+		Oid:            oi.oid,
+		Created:        oi.created.UnixNano(),
+		Expires:        oi.expires.UnixNano(),
+		Size:           oi.size,
+		MaxPulls:       oi.maxPulls,
+		PullsRemaining: oi.pullsRemaining,
+		Uploader:       oi.uploader,
+	}
+}
+
+func deleteEntry(oid string) *journalEntry {
+	return &journalEntry{
+		Op:  journalOpDelete,
+		Oid: oid,
+	}
+}
+
+// Journal records must be appended with the database write lock held, so that they stay in order.
+// Callers sync the journal once the lock is released, so that concurrent requests share a sync.
+// A put that cannot be recorded fails the drop, while pulls and deletes have already been carried out in memory,
+// so a failure to record them is only logged.
+func (journal *Journal) recordPut(oi *ObjectInfo) error {
+	return journal.append(putEntry(oi))
+}
+
+func (journal *Journal) recordPull(oi *ObjectInfo) {
+	_ = journal.append(&journalEntry{
+		Op:             journalOpPull,
+		Oid:            oi.oid,
+		PullsRemaining: oi.pullsRemaining,
+	})
+}
+
+func (journal *Journal) recordDelete(oid string) {
+	_ = journal.append(deleteEntry(oid))
+}
+
+// A partially written entry is truncated, so that entries appended after it can still be replayed.
+func (journal *Journal) append(entry *journalEntry) error {
+	if journal.file == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logger.Errorf("Failed to encode journal entry for object %s: %v", entry.Oid, err)
+		return err
+	}
+
+	n, err := journal.file.Write(append(line, '\n'))
+	if err != nil {
+		logger.Errorf("Failed to append journal entry for object %s: %v", entry.Oid, err)
+		if n > 0 {
+			if truncateErr := journal.file.Truncate(journal.size); truncateErr != nil {
+				logger.Errorf("Failed to truncate partial journal entry: %v", truncateErr)
+			}
+		}
+		return err
+	}
+
+	journal.size += int64(n)
+	return nil
+}
+
+func (journal *Journal) sync() error {
+	if journal.file == nil {
+		return nil
+	}
+
+	if err := journal.file.Sync(); err != nil {
+		logger.Errorf("Failed to sync journal: %v", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/google/logger"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const s3Service = "s3"
+const s3Algorithm = "AWS4-HMAC-SHA256"
+const s3DateFormat = "20060102T150405Z"
+
+type S3Config struct {
+	endpoint  string
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+}
+
+// S3Storage stores objects in any S3-compatible service (e.g. AWS, MinIO), using path-style requests.
+// Uploads are spooled to the data directory first, since S3 needs to know the size of an object up front.
+type S3Storage struct {
+	config   *S3Config
+	endpoint *url.URL
+	spoolDir string
+	client   *http.Client
+}
+
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+}
+
+func newS3Storage(config *S3Config, spoolDir string) (*S3Storage, error) {
+	endpoint, err := url.Parse(config.endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %v", err)
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("endpoint must be an absolute url")
+	}
+	if config.bucket == "" {
+		return nil, fmt.Errorf("a bucket must be specified")
+	}
+
+	return &S3Storage{
+		config:   config,
+		endpoint: endpoint,
+		spoolDir: spoolDir,
+		client:   &http.Client{},
+	}, nil
+}
+
+func (s3 *S3Storage) write(oid string, data io.Reader) (int64, error) {
+	spool, err := ioutil.TempFile(s3.spoolDir, tempFilePrefix+oid+"-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	digest := sha256.New()
+	size, err := io.Copy(io.MultiWriter(spool, digest), data)
+	if err != nil {
+		return size, err
+	}
+	if _, err = spool.Seek(0, io.SeekStart); err != nil {
+		return size, err
+	}
+
+	req, err := http.NewRequest("PUT", s3.objectUrl(oid), ioutil.NopCloser(spool))
+	if err != nil {
+		return size, err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := s3.do(req, hex.EncodeToString(digest.Sum(nil)))
+	if err != nil {
+		return size, err
+	}
+	resp.Body.Close()
+
+	return size, nil
+}
+
+func (s3 *S3Storage) read(oid string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", s3.objectUrl(oid), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s3.sign(req, emptyPayloadHash(), time.Now())
+
+	resp, err := s3.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ObjectNotFoundErr
+	}
+	if err = checkS3Response(req, resp); err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (s3 *S3Storage) remove(oid string) error {
+	req, err := http.NewRequest("DELETE", s3.objectUrl(oid), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s3.do(req, emptyPayloadHash())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+func (s3 *S3Storage) list() ([]StoredObject, error) {
+	listed, err := s3.listPrefix("")
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]StoredObject, 0, len(listed))
+	for _, so := range listed {
+		if so.oid == "" || strings.Contains(so.oid, "/") || isHiddenFile(so.oid) {
+			continue
+		}
+		objects = append(objects, so)
+	}
+	return objects, nil
+}
+
+// Upload chunks are stored in the bucket, so those of uploads interrupted by a restart are only found by listing it.
+func (s3 *S3Storage) removeTempObjects() {
+	removeTempFiles(s3.spoolDir)
+
+	listed, err := s3.listPrefix(tempFilePrefix)
+	if err != nil {
+		logger.Errorf("Failed to list orphaned temp objects: %v", err)
+		return
+	}
+
+	for _, so := range listed {
+		logger.Infof("Removing orphaned temp object %s", so.oid)
+		if err := s3.remove(so.oid); err != nil {
+			logger.Errorf("Failed to remove orphaned temp object %s: %v", so.oid, err)
+		}
+	}
+}
+
+func (s3 *S3Storage) persistent() bool {
+	return true
+}
+
+// Lists every key starting with the configured prefix followed by the given prefix, relative to the configured prefix.
+func (s3 *S3Storage) listPrefix(prefix string) ([]StoredObject, error) {
+	objects := make([]StoredObject, 0)
+
+	continuationToken := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", s3.config.prefix+prefix)
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		req, err := http.NewRequest("GET", s3.bucketUrl()+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := s3.do(req, emptyPayloadHash())
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode bucket listing: %v", err)
+		}
+
+		for _, content := range result.Contents {
+			objects = append(objects, StoredObject{
+				oid:      strings.TrimPrefix(content.Key, s3.config.prefix),
+				size:     content.Size,
+				modified: content.LastModified,
+			})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+func (s3 *S3Storage) bucketUrl() string {
+	return strings.TrimSuffix(s3.endpoint.String(), "/") + "/" + s3URIEscape(s3.config.bucket, true)
+}
+
+func (s3 *S3Storage) objectUrl(oid string) string {
+	return s3.bucketUrl() + "/" + s3URIEscape(s3.config.prefix+oid, false)
+}
+
+func (s3 *S3Storage) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	s3.sign(req, payloadHash, time.Now())
+
+	resp, err := s3.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkS3Response(req, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// Closes the response body if the request failed.
+func checkS3Response(req *http.Request, resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body.Close()
+	return fmt.Errorf("s3 %s request failed with status %s: %s", req.Method, resp.Status, message)
+}
+
+// Signs the request with AWS signature version 4, covering the host and every header already set on the request.
+func (s3 *S3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	timestamp := now.UTC().Format(s3DateFormat)
+	date := timestamp[:8]
+
+	req.Header.Set("X-Amz-Date", timestamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+
+	canonicalHeaders := new(strings.Builder)
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3URIEscape(req.URL.Path, false),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, s3.config.region, s3Service, "aws4_request"}, "/")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		timestamp,
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s3.config.secretKey), date)
+	signingKey = hmacSHA256(signingKey, s3.config.region)
+	signingKey = hmacSHA256(signingKey, s3Service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm,
+		s3.config.accessKey,
+		scope,
+		signedHeaders,
+		signature,
+	))
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, s3URIEscape(key, true)+"="+s3URIEscape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func s3URIEscape(input string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+
+	escaped := new(strings.Builder)
+	for i := 0; i < len(input); i++ {
+		c := input[i]
+		unreserved := 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~'
+		if unreserved || c == '/' && !encodeSlash {
+			escaped.WriteByte(c)
+		} else {
+			escaped.WriteByte('%')
+			escaped.WriteByte(hexDigits[c>>4])
+			escaped.WriteByte(hexDigits[c&15])
+		}
+	}
+	return escaped.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func emptyPayloadHash() string {
+	sum := sha256.Sum256(nil)
+	return hex.EncodeToString(sum[:])
+}
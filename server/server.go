@@ -15,12 +15,22 @@ import (
 )
 
 const ttlMinFlag = "ttl-min"
+const maxTTLMinFlag = "max-ttl-min"
 const dataDirFlag = "data-dir"
 const keysDirFlag = "keys-dir"
+const authorizedKeysFileFlag = "authorized-keys-file"
 const addrFlag = "addr"
 const destructiveReadFlag = "destructive-read"
+const maxPullsFlag = "max-pulls"
 const tlsCertFlag = "tls-cert"
 const tlsKeyFlag = "tls-key"
+const storageFlag = "storage"
+const s3EndpointFlag = "s3-endpoint"
+const s3RegionFlag = "s3-region"
+const s3BucketFlag = "s3-bucket"
+const s3PrefixFlag = "s3-prefix"
+const s3AccessKeyFlag = "s3-access-key"
+const s3SecretKeyFlag = "s3-secret-key"
 
 var confFile string
 
@@ -80,9 +90,12 @@ func loadConfig() {
 	viper.SetDefault(dataDirFlag, "~/dead-drop")
 	viper.SetDefault(keysDirFlag, filepath.Join("~", lib.DefaultConfigDir, "keys"))
 	viper.SetDefault(ttlMinFlag, 1440)
-	viper.SetDefault(destructiveReadFlag, true)
+	viper.SetDefault(maxTTLMinFlag, 10080)
+	viper.SetDefault(maxPullsFlag, 1)
 	viper.SetDefault(tlsCertFlag, filepath.Join("~", lib.DefaultConfigDir, "server.crt"))
 	viper.SetDefault(tlsKeyFlag, filepath.Join("~", lib.DefaultConfigDir, "server.key"))
+	viper.SetDefault(storageFlag, filesystemStorage)
+	viper.SetDefault(s3RegionFlag, "us-east-1")
 
 	err := viper.ReadInConfig()
 	if err != nil {
@@ -98,17 +111,53 @@ func loadConfig() {
 	}
 }
 
+// The destructive-read flag predates per-object pull limits, and is still honoured if max-pulls is not set.
+func defaultMaxPulls() uint {
+	if viper.InConfig(destructiveReadFlag) && !viper.InConfig(maxPullsFlag) {
+		logger.Warningf("The %s option is deprecated, use %s instead", destructiveReadFlag, maxPullsFlag)
+		if !viper.GetBool(destructiveReadFlag) {
+			return unlimitedPulls
+		}
+	}
+	return viper.GetUint(maxPullsFlag)
+}
+
 func startServer() {
-	db := initDatabase(viper.GetString(dataDirFlag), viper.GetUint(ttlMinFlag), viper.GetBool(destructiveReadFlag))
-	auth := newAuthenticator(viper.GetString(keysDirFlag))
+	dataDir, err := homedir.Expand(viper.GetString(dataDirFlag))
+	if err != nil {
+		logger.Fatalf("Failed to locate data directory: %v", err)
+	}
+
+	storage := initStorage(viper.GetString(storageFlag), dataDir, &S3Config{
+		endpoint:  viper.GetString(s3EndpointFlag),
+		region:    viper.GetString(s3RegionFlag),
+		bucket:    viper.GetString(s3BucketFlag),
+		prefix:    viper.GetString(s3PrefixFlag),
+		accessKey: viper.GetString(s3AccessKeyFlag),
+		secretKey: viper.GetString(s3SecretKeyFlag),
+	})
+	db := initDatabase(
+		dataDir,
+		storage,
+		viper.GetUint(ttlMinFlag),
+		viper.GetUint(maxTTLMinFlag),
+		defaultMaxPulls(),
+	)
+	auth := newAuthenticator(viper.GetString(keysDirFlag), viper.GetString(authorizedKeysFileFlag))
 	handler := &Handler{db, auth}
 
 	router := mux.NewRouter()
 
 	router.Handle("/d/{oid}", handler.authenticate(handler.handlePull)).Methods("GET")
+	router.Handle("/d/{oid}", handler.authenticate(handler.handleStatus)).Methods("HEAD")
+	router.Handle("/d/{oid}", handler.authenticate(handler.handleRevoke)).Methods("DELETE")
 	router.Handle("/d", handler.authenticate(handler.handleDrop)).Methods("POST")
+	router.Handle("/u", handler.authenticate(handler.handleCreateUpload)).Methods("POST")
+	router.Handle("/u/{sid}", handler.authenticate(handler.handleUploadStatus)).Methods("GET")
+	router.Handle("/u/{sid}", handler.authenticate(handler.handleFinalizeUpload)).Methods("POST")
+	router.Handle("/u/{sid}/{chunk}", handler.authenticate(handler.handleUploadChunk)).Methods("PUT")
 	router.Handle("/add-key", handler.authenticate(handler.handleAddKey)).Methods("POST")
-	router.HandleFunc("/token", handler.handleToken).Methods("POST")
+	router.HandleFunc("/challenge", handler.handleChallenge).Methods("GET")
 
 	negroniServer := negroni.Classic()
 	negroniServer.UseHandler(router)
@@ -117,7 +166,7 @@ func startServer() {
 	if len(tlsCert) == 0 {
 		logger.Fatalf("A tls certificate must be specified")
 	}
-	tlsCert, err := homedir.Expand(tlsCert)
+	tlsCert, err = homedir.Expand(tlsCert)
 	if err != nil {
 		logger.Fatalf("Failed to load tls certificate: %v", err)
 	}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"dead-drop/lib"
+	"github.com/google/logger"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const filesystemStorage = "filesystem"
+const memoryStorage = "memory"
+const s3Storage = "s3"
+
+const ObjectNotFoundErr = Error("object not found")
+
+// Objects are staged in hidden temp files, so a crash can never leave a partial object in place.
+const tempFilePrefix = ".tmp-"
+
+// Storage holds the contents of objects, while the Database tracks their metadata.
+type Storage interface {
+	write(oid string, data io.Reader) (int64, error)
+	// The returned reader must remain valid even if the object is removed while it is being read.
+	read(oid string) (io.ReadCloser, error)
+	remove(oid string) error
+	list() ([]StoredObject, error)
+	// Removes the temp objects of writes and uploads that were interrupted by a restart.
+	removeTempObjects()
+	// Whether objects survive restarts, in which case the data directory holds temp objects and the journal.
+	persistent() bool
+}
+
+type StoredObject struct {
+	oid      string
+	size     int64
+	modified time.Time
+}
+
+func initStorage(backend string, dataDir string, s3Config *S3Config) Storage {
+	var storage Storage
+	switch backend {
+	case filesystemStorage:
+		storage = &FileStorage{dataDir: dataDir}
+		logger.Infof("Storing objects in data directory %s", dataDir)
+	case memoryStorage:
+		storage = newMemoryStorage()
+		logger.Infof("Storing objects in memory, they will not survive restarts")
+	case s3Storage:
+		s3, err := newS3Storage(s3Config, dataDir)
+		if err != nil {
+			logger.Fatalf("Failed to configure s3 storage: %v", err)
+		}
+		storage = s3
+		logger.Infof("Storing objects in s3 bucket %s at %s", s3Config.bucket, s3Config.endpoint)
+	default:
+		logger.Fatalf("Unknown storage backend %s", backend)
+		return nil
+	}
+
+	if storage.persistent() {
+		if err := os.MkdirAll(dataDir, 0770); err != nil {
+			logger.Fatalf("Failed to create data directory: %v", err)
+		}
+		storage.removeTempObjects()
+	}
+	return storage
+}
+
+func removeTempFiles(dataDir string) {
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		logger.Errorf("Failed to list data directory: %v", err)
+		return
+	}
+
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), tempFilePrefix) {
+			continue
+		}
+
+		logger.Infof("Removing orphaned temp file %s", file.Name())
+		if err := os.Remove(filepath.Join(dataDir, file.Name())); err != nil {
+			logger.Errorf("Failed to remove orphaned temp file %s: %v", file.Name(), err)
+		}
+	}
+}
+
+type FileStorage struct {
+	dataDir string
+}
+
+// Objects are written to a temp file, synced, and then renamed into place.
+func (fs *FileStorage) write(oid string, data io.Reader) (int64, error) {
+	file, err := ioutil.TempFile(fs.dataDir, tempFilePrefix+oid+"-")
+	if err != nil {
+		return 0, err
+	}
+	tempPath := file.Name()
+
+	size, err := io.Copy(file, data)
+	if err == nil {
+		err = file.Chmod(lib.ObjectPerms)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, fs.objectPath(oid))
+	}
+	if err != nil {
+		_ = os.Remove(tempPath)
+		return size, err
+	}
+
+	if err = syncDir(fs.dataDir); err != nil {
+		_ = os.Remove(fs.objectPath(oid))
+		return size, err
+	}
+	return size, nil
+}
+
+func (fs *FileStorage) read(oid string) (io.ReadCloser, error) {
+	file, err := os.Open(fs.objectPath(oid))
+	if os.IsNotExist(err) {
+		return nil, ObjectNotFoundErr
+	}
+	return file, err
+}
+
+func (fs *FileStorage) remove(oid string) error {
+	return os.Remove(fs.objectPath(oid))
+}
+
+func (fs *FileStorage) list() ([]StoredObject, error) {
+	files, err := ioutil.ReadDir(fs.dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]StoredObject, 0, len(files))
+	for _, file := range files {
+		if isHiddenFile(file.Name()) || !file.Mode().IsRegular() {
+			continue
+		}
+
+		objects = append(objects, StoredObject{
+			oid:      file.Name(),
+			size:     file.Size(),
+			modified: file.ModTime(),
+		})
+	}
+
+	return objects, nil
+}
+
+func (fs *FileStorage) removeTempObjects() {
+	removeTempFiles(fs.dataDir)
+}
+
+func (fs *FileStorage) persistent() bool {
+	return true
+}
+
+func (fs *FileStorage) objectPath(oid string) string {
+	return filepath.Join(fs.dataDir, oid)
+}
+
+// Syncing the directory makes a rename within it durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// MemoryStorage keeps objects on the heap, for tests and deployments that must never touch a disk.
+// The database keeps no journal for it, so no metadata is written to the data directory either.
+type MemoryStorage struct {
+	lock    sync.RWMutex
+	objects map[string]StoredBytes
+}
+
+type StoredBytes struct {
+	data     []byte
+	modified time.Time
+}
+
+func newMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		objects: make(map[string]StoredBytes),
+	}
+}
+
+func (ms *MemoryStorage) write(oid string, data io.Reader) (int64, error) {
+	bytes, err := ioutil.ReadAll(data)
+	if err != nil {
+		return int64(len(bytes)), err
+	}
+
+	ms.lock.Lock()
+	ms.objects[oid] = StoredBytes{
+		data:     bytes,
+		modified: time.Now(),
+	}
+	ms.lock.Unlock()
+
+	return int64(len(bytes)), nil
+}
+
+func (ms *MemoryStorage) read(oid string) (io.ReadCloser, error) {
+	ms.lock.RLock()
+	stored, ok := ms.objects[oid]
+	ms.lock.RUnlock()
+	if !ok {
+		return nil, ObjectNotFoundErr
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(stored.data)), nil
+}
+
+func (ms *MemoryStorage) remove(oid string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if _, ok := ms.objects[oid]; !ok {
+		return ObjectNotFoundErr
+	}
+	delete(ms.objects, oid)
+	return nil
+}
+
+// Nothing held in memory survives a restart, so there is never anything to clean up.
+func (ms *MemoryStorage) removeTempObjects() {}
+
+func (ms *MemoryStorage) persistent() bool {
+	return false
+}
+
+func (ms *MemoryStorage) list() ([]StoredObject, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	objects := make([]StoredObject, 0, len(ms.objects))
+	for oid, stored := range ms.objects {
+		if isHiddenFile(oid) {
+			continue
+		}
+
+		objects = append(objects, StoredObject{
+			oid:      oid,
+			size:     int64(len(stored.data)),
+			modified: stored.modified,
+		})
+	}
+
+	return objects, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"dead-drop/lib"
+	"fmt"
+	"github.com/google/logger"
+	"io"
+	"time"
+)
+
+// Upload sessions that receive no chunks for this long are abandoned, along with their chunks.
+const uploadIdleTTL = time.Hour
+const maxUploadChunkSize = 64 << 20
+
+const UploadNotFoundErr = Error("upload session not found")
+const UploadConflictErr = Error("upload chunk out of order")
+
+// An UploadSession accumulates the chunks of a large drop, which are only turned into an object once finalized.
+// Sessions live in memory, so uploads in progress do not survive restarts, and their chunks are removed on startup.
+type UploadSession struct {
+	sid      string
+	uploader string
+	ttl      time.Duration
+	maxPulls int
+	chunks   uint64
+	offset   int64
+	busy     bool
+	oid      string
+	expires  time.Time
+}
+
+func (db *Database) createUpload(uploader string, ttl time.Duration, maxPulls int) string {
+	const sidLen = 24
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	sid := db.randomOid(sidLen)
+	for _, ok := db.uploads[sid]; ok; _, ok = db.uploads[sid] {
+		sid = db.randomOid(sidLen)
+	}
+
+	db.uploads[sid] = &UploadSession{
+		sid:      sid,
+		uploader: uploader,
+		ttl:      ttl,
+		maxPulls: maxPulls,
+		expires:  time.Now().Add(uploadIdleTTL),
+	}
+
+	return sid
+}
+
+func (db *Database) uploadStatus(sid string, uploader string) (*lib.UploadStatusPayload, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	session, ok := db.uploads[sid]
+	if !ok || session.uploader != uploader {
+		return nil, UploadNotFoundErr
+	}
+
+	return &lib.UploadStatusPayload{
+		Chunks: session.chunks,
+		Offset: session.offset,
+		Oid:    session.oid,
+	}, nil
+}
+
+// Chunks must arrive in order, but re-sending a chunk that was already received is harmless.
+func (db *Database) uploadChunk(sid string, uploader string, index uint64, data io.Reader) error {
+	db.lock.Lock()
+
+	session, ok := db.uploads[sid]
+	if !ok || session.uploader != uploader {
+		db.lock.Unlock()
+		return UploadNotFoundErr
+	}
+	if index < session.chunks {
+		db.lock.Unlock()
+		return nil
+	}
+	if index > session.chunks || session.busy || session.oid != "" {
+		db.lock.Unlock()
+		return UploadConflictErr
+	}
+
+	session.busy = true
+	db.lock.Unlock()
+
+	size, err := db.storage.write(uploadChunkName(sid, index), data)
+	if err != nil {
+		logger.Errorf("Failed to write chunk %d of upload %s: %v", index, sid, err)
+	}
+
+	db.lock.Lock()
+	session.busy = false
+	if err == nil {
+		session.chunks++
+		session.offset += size
+		session.expires = time.Now().Add(uploadIdleTTL)
+	}
+	db.lock.Unlock()
+
+	return err
+}
+
+// Finalizing an upload drops its chunks as a single object. Finalizing again returns the same oid,
+// so that a client which lost the first response can still learn it.
+func (db *Database) finalizeUpload(sid string, uploader string) (string, time.Duration, error) {
+	db.lock.Lock()
+
+	session, ok := db.uploads[sid]
+	if !ok || session.uploader != uploader {
+		db.lock.Unlock()
+		return "", 0, UploadNotFoundErr
+	}
+	if session.oid != "" {
+		db.lock.Unlock()
+		return session.oid, session.ttl, nil
+	}
+	if session.busy {
+		db.lock.Unlock()
+		return "", 0, UploadConflictErr
+	}
+
+	session.busy = true
+	chunks := session.chunks
+	db.lock.Unlock()
+
+	reader := &chunkReader{
+		storage: db.storage,
+		sid:     sid,
+		chunks:  chunks,
+	}
+	oid, ttl, err := db.drop(reader, uploader, session.ttl, session.maxPulls)
+	reader.Close()
+
+	db.lock.Lock()
+	session.busy = false
+	if err == nil {
+		session.oid = oid
+		session.ttl = ttl
+		session.expires = time.Now().Add(uploadIdleTTL)
+	}
+	db.lock.Unlock()
+
+	if err == nil {
+		db.removeUploadChunks(sid, chunks)
+	}
+
+	return oid, ttl, err
+}
+
+func (db *Database) expireUploads() {
+	expired := make([]*UploadSession, 0)
+
+	db.lock.Lock()
+	for sid, session := range db.uploads {
+		if !session.busy && session.expires.Before(time.Now()) {
+			delete(db.uploads, sid)
+			expired = append(expired, session)
+		}
+	}
+	db.lock.Unlock()
+
+	for _, session := range expired {
+		if session.oid == "" {
+			logger.Infof("Removing abandoned upload %s", session.sid)
+			db.removeUploadChunks(session.sid, session.chunks)
+		}
+	}
+}
+
+func (db *Database) removeUploadChunks(sid string, chunks uint64) {
+	for index := uint64(0); index < chunks; index++ {
+		if err := db.storage.remove(uploadChunkName(sid, index)); err != nil {
+			logger.Errorf("Failed to remove chunk %d of upload %s: %v", index, sid, err)
+		}
+	}
+}
+
+// Chunks are stored as hidden objects, so they are never indexed as drops.
+func uploadChunkName(sid string, index uint64) string {
+	return fmt.Sprintf("%supload-%s-%d", tempFilePrefix, sid, index)
+}
+
+// chunkReader reads the chunks of an upload back to back, opening each one only when it is reached.
+type chunkReader struct {
+	storage Storage
+	sid     string
+	chunks  uint64
+	next    uint64
+	current io.ReadCloser
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if cr.current == nil {
+			if cr.next == cr.chunks {
+				return 0, io.EOF
+			}
+
+			chunk, err := cr.storage.read(uploadChunkName(cr.sid, cr.next))
+			if err != nil {
+				return 0, err
+			}
+			cr.current = chunk
+			cr.next++
+		}
+
+		n, err := cr.current.Read(p)
+		if err == io.EOF {
+			cr.current.Close()
+			cr.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (cr *chunkReader) Close() error {
+	if cr.current == nil {
+		return nil
+	}
+	err := cr.current.Close()
+	cr.current = nil
+	return err
+}